@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a username and password that checked out are trusted without
+// running bcrypt again, which takes tens of milliseconds
+const basicAuthCacheTTL = time.Minute
+
+// Most credentials kept in the cache. It starts over when full.
+const basicAuthCacheSize = 1024
+
+// AccessConfig restricts who can use a service, eg
+// {"allow": ["10.0.0.0/8"], "deny": ["10.1.2.0/24"], "basic_auth": {"users": {"alice": "$2a$10$..."}}}
+type AccessConfig struct {
+	// Only clients in these CIDRs or addresses. Defaults to everyone.
+	Allow []string `json:"allow"`
+	// Never clients in these, even when they are allowed
+	Deny []string `json:"deny"`
+	// Ask for a username and password too
+	BasicAuth BasicAuthConfig `json:"basic_auth"`
+}
+
+// BasicAuthConfig holds bcrypt hashes of each user's password
+type BasicAuthConfig struct {
+	// Shown by browsers when asking for a password. Defaults to the service name.
+	Realm string            `json:"realm"`
+	Users map[string]string `json:"users"`
+}
+
+func (c AccessConfig) enabled() bool {
+	return len(c.Allow) > 0 || len(c.Deny) > 0 || len(c.BasicAuth.Users) > 0
+}
+
+// accessRules is an AccessConfig ready to check requests with
+type accessRules struct {
+	allow Networks
+	deny  Networks
+	realm string
+	users map[string][]byte
+	// Checked for unknown users, so they take as long as known ones
+	dummy []byte
+	// Set when the config can't be used, so nobody gets in until it is fixed
+	broken bool
+
+	mu       sync.Mutex
+	salt     []byte
+	verified map[[sha256.Size]byte]time.Time
+	now      func() time.Time
+}
+
+func newAccessRules(s Service) *accessRules {
+	c := s.Access
+	rules := &accessRules{realm: c.BasicAuth.Realm, now: time.Now}
+	if rules.realm == "" {
+		rules.realm = s.Name
+	}
+	var err error
+	if rules.allow, err = ParseNetworks(strings.Join(c.Allow, ",")); err != nil {
+		return brokenAccessRules(s, fmt.Errorf("allow: %s", err))
+	}
+	if rules.deny, err = ParseNetworks(strings.Join(c.Deny, ",")); err != nil {
+		return brokenAccessRules(s, fmt.Errorf("deny: %s", err))
+	}
+	if len(c.BasicAuth.Users) > 0 {
+		rules.users = make(map[string][]byte)
+		cost := bcrypt.MinCost
+		for user, hash := range c.BasicAuth.Users {
+			userCost, err := bcrypt.Cost([]byte(hash))
+			if err != nil {
+				return brokenAccessRules(s, fmt.Errorf("basic_auth: user '%s' does not have a bcrypt hash", user))
+			}
+			if userCost > cost {
+				cost = userCost
+			}
+			rules.users[user] = []byte(hash)
+		}
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		rules.dummy, _ = bcrypt.GenerateFromPassword(salt, cost)
+		rules.salt = salt
+		rules.verified = make(map[[sha256.Size]byte]time.Time)
+	}
+	return rules
+}
+
+func brokenAccessRules(s Service, err error) *accessRules {
+	log.WithFields(log.Fields{"mount_point": s.MountPoint,
+		"error": err}).Error("Invalid access config, refusing every request until it is fixed")
+	return &accessRules{broken: true}
+}
+
+// allows reports whether the client address may use the service
+func (a *accessRules) allows(address string) bool {
+	if a.broken || a.deny.Contains(address) {
+		return false
+	}
+	return len(a.allow) == 0 || a.allow.Contains(address)
+}
+
+// authenticates checks the request's basic auth credentials, if we want any
+func (a *accessRules) authenticates(r *http.Request) (string, bool) {
+	if a.users == nil {
+		return "", true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	key := sha256.Sum256([]byte(string(a.salt) + user + "\x00" + password))
+	if a.recentlyVerified(key) {
+		return user, true
+	}
+	hash, ok := a.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(a.dummy, []byte(password))
+		return user, false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return user, false
+	}
+	a.mu.Lock()
+	if len(a.verified) >= basicAuthCacheSize {
+		a.verified = make(map[[sha256.Size]byte]time.Time)
+	}
+	a.verified[key] = a.now().Add(basicAuthCacheTTL)
+	a.mu.Unlock()
+	return user, true
+}
+
+func (a *accessRules) recentlyVerified(key [sha256.Size]byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expires, ok := a.verified[key]
+	return ok && a.now().Before(expires)
+}
+
+// Access holds the access rules for every service, by name since that is the
+// KV key, so they can change as service definitions do
+type Access struct {
+	mu    sync.RWMutex
+	rules map[string]*accessRules
+}
+
+func NewAccess() *Access {
+	return &Access{rules: make(map[string]*accessRules)}
+}
+
+func (a *Access) set(s Service) {
+	var rules *accessRules
+	if s.Access.enabled() {
+		rules = newAccessRules(s)
+	}
+	a.mu.Lock()
+	a.rules[s.Name] = rules
+	a.mu.Unlock()
+}
+
+// Update takes the rules from a changed service definition
+func (a *Access) Update(s Service) {
+	a.set(s)
+	log.WithFields(log.Fields{"mount_point": s.MountPoint,
+		"allow": len(s.Access.Allow), "deny": len(s.Access.Deny),
+		"users": len(s.Access.BasicAuth.Users)}).Info("Updated access rules")
+}
+
+func (a *Access) rulesFor(name string) *accessRules {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.rules[name]
+}
+
+// Wrap turns away clients the service's rules don't allow, with a 403, and
+// asks for a password with a 401 when the service wants one
+func (a *Access) Wrap(s Service, handler http.Handler) http.Handler {
+	a.set(s)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := a.rulesFor(s.Name)
+		if rules == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !rules.allows(clientIP(r)) {
+			forbidden(w, r, "client_ip")
+			return
+		}
+		user, ok := rules.authenticates(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`,
+				strings.ReplaceAll(rules.realm, `"`, `'`)))
+			passwordRequired(w, r, user)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAccess(c AccessConfig) (*Access, http.Handler) {
+	access := NewAccess()
+	s := Service{Name: "tools", MountPoint: "/tools", Access: c}
+	return access, access.Wrap(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+}
+
+func accessRequest(handler http.Handler, remoteAddr string, setup func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/tools/jobs", nil)
+	r.RemoteAddr = remoteAddr
+	if setup != nil {
+		setup(r)
+	}
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+	return res
+}
+
+func TestAccessAllowAndDeny(t *testing.T) {
+	_, handler := newTestAccess(AccessConfig{Allow: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny: []string{"10.1.2.0/24", "10.9.9.9"}})
+
+	tests := map[string]int{
+		"10.0.0.1:1234":         http.StatusOK,
+		"[2001:db8::1]:1234":    http.StatusOK,
+		"10.1.2.3:1234":         http.StatusForbidden,
+		"10.9.9.9:1234":         http.StatusForbidden,
+		"192.168.0.1:1234":      http.StatusForbidden,
+		"[2001:db9::1]:1234":    http.StatusForbidden,
+		"not an address at all": http.StatusForbidden,
+	}
+	for remoteAddr, status := range tests {
+		res := accessRequest(handler, remoteAddr, nil)
+		if res.Code != status {
+			t.Errorf("%s: expected %d but got %d", remoteAddr, status, res.Code)
+		}
+		if status == http.StatusForbidden &&
+			!strings.HasPrefix(res.Body.String(), `{"error":"forbidden","message":"You are not allowed to access '/tools/jobs'"`) {
+			t.Errorf("%s: unexpected body %s", remoteAddr, res.Body.String())
+		}
+	}
+}
+
+func TestAccessUsesClientBehindTrustedProxy(t *testing.T) {
+	_, handler := newTestAccess(AccessConfig{Deny: []string{"203.0.113.7"}})
+	forwarding, err := NewForwarding("10.0.0.0/8", "x-forwarded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = forwarding.Wrap(handler)
+
+	res := accessRequest(handler, "10.0.0.1:1234", func(r *http.Request) {
+		r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	})
+	if res.Code != http.StatusForbidden {
+		t.Errorf("Expected the client behind the proxy to be denied but got %d", res.Code)
+	}
+	// An untrusted client can't get around the list by claiming to be someone else
+	res = accessRequest(handler, "203.0.113.7:1234", func(r *http.Request) {
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	})
+	if res.Code != http.StatusForbidden {
+		t.Errorf("Expected a forged X-Forwarded-For to be ignored but got %d", res.Code)
+	}
+}
+
+func TestAccessBasicAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	_, handler := newTestAccess(AccessConfig{BasicAuth: BasicAuthConfig{Realm: "ops",
+		Users: map[string]string{"alice": string(hash)}}})
+
+	tests := map[string]struct {
+		user, password string
+		status         int
+	}{
+		"no credentials": {"", "", http.StatusUnauthorized},
+		"wrong password": {"alice", "guess", http.StatusUnauthorized},
+		"unknown user":   {"mallory", "s3cret", http.StatusUnauthorized},
+		"valid":          {"alice", "s3cret", http.StatusOK},
+	}
+	for name, test := range tests {
+		res := accessRequest(handler, "10.0.0.1:1234", func(r *http.Request) {
+			if test.user != "" {
+				r.SetBasicAuth(test.user, test.password)
+			}
+		})
+		if res.Code != test.status {
+			t.Errorf("%s: expected %d but got %d", name, test.status, res.Code)
+		}
+		if test.status == http.StatusUnauthorized &&
+			res.Header().Get("WWW-Authenticate") != `Basic realm="ops", charset="UTF-8"` {
+			t.Errorf("%s: expected a basic challenge but got '%s'", name, res.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestAccessUpdate(t *testing.T) {
+	access, handler := newTestAccess(AccessConfig{})
+	if res := accessRequest(handler, "192.168.0.1:1234", nil); res.Code != http.StatusOK {
+		t.Fatalf("Expected everyone to be let in without rules but got %d", res.Code)
+	}
+
+	access.Update(Service{Name: "tools", MountPoint: "/tools", Access: AccessConfig{Allow: []string{"10.0.0.0/8"}}})
+	if res := accessRequest(handler, "192.168.0.1:1234", nil); res.Code != http.StatusForbidden {
+		t.Errorf("Expected the new allow list to be used but got %d", res.Code)
+	}
+
+	// A broken definition shuts the service rather than opening it up
+	access.Update(Service{Name: "tools", MountPoint: "/tools", Access: AccessConfig{Allow: []string{"10.0.0.0/33"}}})
+	if res := accessRequest(handler, "10.0.0.1:1234", nil); res.Code != http.StatusForbidden {
+		t.Errorf("Expected an invalid allow list to refuse everyone but got %d", res.Code)
+	}
+	access.Update(Service{Name: "tools", MountPoint: "/tools", Access: AccessConfig{
+		BasicAuth: BasicAuthConfig{Users: map[string]string{"alice": "s3cret"}}}})
+	res := accessRequest(handler, "10.0.0.1:1234", func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") })
+	if res.Code != http.StatusForbidden {
+		t.Errorf("Expected a plain text password to refuse everyone but got %d", res.Code)
+	}
+
+	access.Update(Service{Name: "tools", MountPoint: "/tools"})
+	if res := accessRequest(handler, "192.168.0.1:1234", nil); res.Code != http.StatusOK {
+		t.Errorf("Expected the rules to be removed but got %d", res.Code)
+	}
+}
+
+func TestAccessUpdateFollowsServiceName(t *testing.T) {
+	access, handler := newTestAccess(AccessConfig{})
+	// The definition moves the service, which takes effect on restart, but its
+	// rules apply straight away
+	access.Update(Service{Name: "tools", MountPoint: "/ops-tools", Access: AccessConfig{Deny: []string{"192.168.0.1"}}})
+	if res := accessRequest(handler, "192.168.0.1:1234", nil); res.Code != http.StatusForbidden {
+		t.Errorf("Expected the rules to follow the service to its new mount point but got %d", res.Code)
+	}
+}
+
+func TestAccessBasicAuthCache(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost+1)
+	rules := newAccessRules(Service{Name: "tools", Access: AccessConfig{BasicAuth: BasicAuthConfig{
+		Users: map[string]string{"alice": string(hash)}}}})
+	if cost, _ := bcrypt.Cost(rules.dummy); cost != bcrypt.MinCost+1 {
+		t.Errorf("Expected unknown users to be checked at the users' cost but got %d", cost)
+	}
+	now := time.Now()
+	rules.now = func() time.Time { return now }
+
+	request := func(password string) *http.Request {
+		r := httptest.NewRequest("GET", "/tools/jobs", nil)
+		r.SetBasicAuth("alice", password)
+		return r
+	}
+	if _, ok := rules.authenticates(request("s3cret")); !ok {
+		t.Fatal("Expected the password to be accepted")
+	}
+	// Changing the hash behind the cache's back shows whether bcrypt ran again
+	rules.users["alice"] = []byte("not a hash")
+	if _, ok := rules.authenticates(request("s3cret")); !ok {
+		t.Error("Expected a recently checked password to be accepted from the cache")
+	}
+	if _, ok := rules.authenticates(request("guess")); ok {
+		t.Error("Expected a different password not to be accepted from the cache")
+	}
+	now = now.Add(2 * basicAuthCacheTTL)
+	if _, ok := rules.authenticates(request("s3cret")); ok {
+		t.Error("Expected the cached check to expire")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The Apache combined log format's timestamp
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogEntry is what the access log knows about a request. It is filled in
+// by the handlers the request passes through and written once the response is
+// done.
+type AccessLogEntry struct {
+	Time     time.Time
+	ClientIP string
+	User     string
+	Method   string
+	// The path and query as the client sent them
+	Path      string
+	Protocol  string
+	Host      string
+	Referer   string
+	UserAgent string
+	RequestID string
+	// Set when the request is traced
+	TraceID string
+
+	// Set when the request reaches a service
+	MountPoint    string
+	Version       string
+	RewrittenPath string
+	Node          string
+
+	Status         int
+	UpstreamStatus int
+	BytesReceived  int64
+	BytesSent      int64
+	// From the request arriving to the response being done
+	Duration time.Duration
+	// From sending the request to the node to getting its response headers
+	UpstreamDuration time.Duration
+
+	upstreamStart time.Time
+}
+
+type accessLogKey struct{}
+
+// accessLogEntryFrom returns the request's access log entry, or nil if the
+// request isn't being logged
+func accessLogEntryFrom(r *http.Request) *AccessLogEntry {
+	entry, _ := r.Context().Value(accessLogKey{}).(*AccessLogEntry)
+	return entry
+}
+
+// detachContext is for work that carries on after the response, like mirrored
+// requests and background cache refreshes. It keeps the request's values but
+// isn't canceled with it, and leaves out the access log entry and span because
+// they will have been written already.
+func detachContext(ctx context.Context) context.Context {
+	return subrequestContext(context.WithoutCancel(ctx))
+}
+
+// subrequestContext is for requests conductor makes on a client's behalf, like
+// auth subrequests. They are canceled with the client's request but leave its
+// access log entry and span alone.
+func subrequestContext(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, accessLogKey{}, (*AccessLogEntry)(nil))
+	return context.WithValue(ctx, spanKey{}, (*Span)(nil))
+}
+
+// proxying notes where the reverse proxy is sending the request
+func (e *AccessLogEntry) proxying(mountPoint string, req *http.Request) {
+	e.MountPoint = mountPoint
+	e.RewrittenPath = req.URL.Path
+	e.Node = req.URL.Host
+	e.upstreamStart = time.Now()
+}
+
+// proxied notes the response the node sent back
+func (e *AccessLogEntry) proxied(res *http.Response) {
+	e.UpstreamStatus = res.StatusCode
+	e.UpstreamDuration = time.Since(e.upstreamStart)
+}
+
+// AccessLog writes a line for every request once its response is done
+type AccessLog struct {
+	mu          sync.Mutex
+	destination string
+	out         io.Writer
+	file        *os.File
+	format      func(e *AccessLogEntry) []byte
+	// Share of requests to log, from 0 to 1. Server errors are always logged.
+	sample float64
+	random func() float64
+}
+
+// NewAccessLog writes to destination, which is "stdout", "stderr" or a file
+// name, in format, which is "combined", "json" or a text/template using the
+// AccessLogEntry fields like "{{.Method}} {{.Path}} {{.Status}}"
+func NewAccessLog(destination, format string, sample float64) (*AccessLog, error) {
+	formatter, err := accessLogFormatter(format)
+	if err != nil {
+		return nil, err
+	}
+	l := &AccessLog{destination: destination, format: formatter, sample: sample, random: rand.Float64}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func accessLogFormatter(format string) (func(e *AccessLogEntry) []byte, error) {
+	switch format {
+	case "", "combined":
+		return formatCombined, nil
+	case "json":
+		return formatJSON, nil
+	}
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	tmpl, err := template.New("access_log").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("access log format: %s", err)
+	}
+	return func(e *AccessLogEntry) []byte {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, e); err != nil {
+			return []byte(fmt.Sprintf("access log format: %s\n", err))
+		}
+		return b.Bytes()
+	}, nil
+}
+
+// Reopen opens the log file again, so it can be rotated
+func (l *AccessLog) Reopen() error {
+	var out io.Writer
+	var file *os.File
+	switch l.destination {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(l.destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		out, file = f, f
+	}
+
+	l.mu.Lock()
+	old := l.file
+	l.out, l.file = out, file
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Wrap logs every request handler serves
+func (l *AccessLog) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &AccessLogEntry{Time: start, ClientIP: clientIP(r), Method: r.Method, Path: r.RequestURI,
+			Protocol: r.Proto, Host: r.Host, Referer: r.Referer(), UserAgent: r.UserAgent(), RequestID: requestIDFrom(r)}
+		if user, _, ok := r.BasicAuth(); ok {
+			entry.User = user
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		sw := newStatusWriter(w)
+		handler.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+		entry.Status = sw.Status()
+		if sw.status == 0 && entry.UpstreamStatus == http.StatusSwitchingProtocols {
+			// The tunnel was hijacked, so the status never went through us
+			entry.Status = http.StatusSwitchingProtocols
+		}
+		entry.BytesReceived = body.n
+		entry.BytesSent = sw.bytes
+		entry.Duration = time.Since(start)
+		l.Log(entry)
+	})
+}
+
+// Log writes the entry if it is sampled
+func (l *AccessLog) Log(e *AccessLogEntry) {
+	if e.Status < http.StatusInternalServerError && l.sample < 1 && l.random() >= l.sample {
+		return
+	}
+	line := l.format(e)
+	l.mu.Lock()
+	l.out.Write(line)
+	l.mu.Unlock()
+}
+
+// countingReader counts the bytes of the request body read by the handlers
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// formatCombined writes the Apache combined log format
+func formatCombined(e *AccessLogEntry) []byte {
+	bytesSent := "-"
+	if e.BytesSent > 0 {
+		bytesSent = fmt.Sprint(e.BytesSent)
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		e.ClientIP, dashIfEmpty(escapeLogField(e.User)), e.Time.Format(combinedTimeFormat),
+		escapeLogField(e.Method), escapeLogField(e.Path), escapeLogField(e.Protocol), e.Status, bytesSent,
+		dashIfEmpty(escapeLogField(e.Referer)), dashIfEmpty(escapeLogField(e.UserAgent))))
+}
+
+func formatJSON(e *AccessLogEntry) []byte {
+	line, _ := json.Marshal(struct {
+		Time             string  `json:"time"`
+		ClientIP         string  `json:"client_ip"`
+		User             string  `json:"user,omitempty"`
+		Method           string  `json:"method"`
+		Path             string  `json:"path"`
+		Protocol         string  `json:"protocol"`
+		Host             string  `json:"host"`
+		Referer          string  `json:"referer,omitempty"`
+		UserAgent        string  `json:"user_agent,omitempty"`
+		RequestID        string  `json:"request_id,omitempty"`
+		TraceID          string  `json:"trace_id,omitempty"`
+		MountPoint       string  `json:"mount_point,omitempty"`
+		Version          string  `json:"version,omitempty"`
+		RewrittenPath    string  `json:"rewritten_path,omitempty"`
+		Node             string  `json:"node,omitempty"`
+		Status           int     `json:"status"`
+		UpstreamStatus   int     `json:"upstream_status,omitempty"`
+		BytesReceived    int64   `json:"bytes_received"`
+		BytesSent        int64   `json:"bytes_sent"`
+		Duration         float64 `json:"duration_ms"`
+		UpstreamDuration float64 `json:"upstream_duration_ms,omitempty"`
+	}{
+		e.Time.Format(time.RFC3339Nano), e.ClientIP, e.User, e.Method, e.Path, e.Protocol, e.Host,
+		e.Referer, e.UserAgent, e.RequestID, e.TraceID, e.MountPoint, e.Version, e.RewrittenPath, e.Node, e.Status,
+		e.UpstreamStatus, e.BytesReceived, e.BytesSent, milliseconds(e.Duration), milliseconds(e.UpstreamDuration),
+	})
+	return append(line, '\n')
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// escapeLogField escapes quotes, backslashes and control characters the way
+// Apache does, so a field can't break up the line
+func escapeLogField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
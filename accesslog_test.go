@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAccessLog(t *testing.T, format string) (*AccessLog, *bytes.Buffer) {
+	l, err := NewAccessLog("stdout", format, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	l.out = &out
+	return l, &out
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	e := &AccessLogEntry{Time: time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60)),
+		ClientIP: "127.0.0.1", User: "frank", Method: "GET", Path: "/apache_pb.gif", Protocol: "HTTP/1.0",
+		Status: 200, BytesSent: 2326, Referer: "http://www.example.com/start.html", UserAgent: `Mozilla/4.08 "quoted"`}
+	expected := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""` + "\n"
+	if line := string(formatCombined(e)); line != expected {
+		t.Errorf("Expected\n%s but got\n%s", expected, line)
+	}
+
+	e = &AccessLogEntry{ClientIP: "10.0.0.1", Method: "GET", Path: "/x", Protocol: "HTTP/1.1", Status: 204}
+	if line := string(formatCombined(e)); !strings.Contains(line, `"GET /x HTTP/1.1" 204 - "-" "-"`) {
+		t.Errorf("Expected dashes for the missing fields but got %s", line)
+	}
+}
+
+func TestAccessLogTemplate(t *testing.T) {
+	l, out := newTestAccessLog(t, "{{.Method}} {{.Path}} {{.Status}} {{.MountPoint}}")
+	l.Log(&AccessLogEntry{Method: "POST", Path: "/api/users", Status: 201, MountPoint: "/api"})
+	if out.String() != "POST /api/users 201 /api\n" {
+		t.Errorf("Expected the template to be used but got '%s'", out.String())
+	}
+
+	if _, err := NewAccessLog("stdout", "{{.Method", 1); err == nil {
+		t.Error("Expected a broken template to be an error")
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	l, out := newTestAccessLog(t, "{{.Status}}")
+	l.sample = 0.1
+	l.random = func() float64 { return 0.5 }
+	l.Log(&AccessLogEntry{Status: 200})
+	l.Log(&AccessLogEntry{Status: 502})
+	l.random = func() float64 { return 0.05 }
+	l.Log(&AccessLogEntry{Status: 404})
+	if out.String() != "502\n404\n" {
+		t.Errorf("Expected the sampled request and the error to be logged but got '%s'", out.String())
+	}
+}
+
+func TestAccessLogThroughProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer backend.Close()
+	s := serviceForTestServer("users", "/api", backend)
+	proxy, stop := newTestProxy(t, s)
+	defer stop()
+
+	l, out := newTestAccessLog(t, "json")
+	r := httptest.NewRequest("POST", "/api/users?page=2", strings.NewReader(`{"name":"bob"}`))
+	r.RemoteAddr = "192.0.2.1:5555"
+	l.Wrap(proxy).ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON line but got '%s': %s", out.String(), err)
+	}
+	expected := map[string]interface{}{
+		"client_ip":       "192.0.2.1",
+		"method":          "POST",
+		"path":            "/api/users?page=2",
+		"mount_point":     "/api",
+		"rewritten_path":  "/users",
+		"node":            backend.Listener.Addr().String(),
+		"status":          201.0,
+		"upstream_status": 201.0,
+		"bytes_received":  14.0,
+		"bytes_sent":      7.0,
+	}
+	for field, value := range expected {
+		if entry[field] != value {
+			t.Errorf("Expected %s to be %v but got %v", field, value, entry[field])
+		}
+	}
+	if _, ok := entry["upstream_duration_ms"]; !ok {
+		t.Error("Expected the upstream duration to be logged")
+	}
+}
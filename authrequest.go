@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// The version the authorization service of a mount point is balanced as
+const AuthRequestVersion = "auth"
+
+// The most of a denial's body that is passed back to the client
+const maxAuthResponseSize = 64 << 10
+
+// AuthRequestConfig asks an authorization service about every request before
+// it is proxied, like nginx's auth_request, eg
+// {"service": "authz", "path": "/check", "response_headers": ["X-User-Id"]}
+type AuthRequestConfig struct {
+	// The Consul service to ask, balanced like any other service
+	Service string `json:"service"`
+	// The path to ask on. Defaults to the path the request is proxied with.
+	Path string `json:"path"`
+	// Headers copied from a 2xx answer onto the proxied request. Clients can't
+	// set these themselves.
+	ResponseHeaders []string `json:"response_headers"`
+	// How long the authorization service gets to answer. Defaults to 5s.
+	Timeout Duration `json:"timeout"`
+}
+
+func (c AuthRequestConfig) enabled() bool {
+	return c.Service != ""
+}
+
+// AuthService returns the service auth subrequests go to, or nil if the
+// service doesn't use one. It shares the mount point so subrequest paths are
+// rewritten the same way.
+func (s Service) AuthService() *Service {
+	if !s.AuthRequest.enabled() {
+		return nil
+	}
+	return &Service{
+		Name:       s.AuthRequest.Service,
+		MountPoint: s.MountPoint,
+		Version:    AuthRequestVersion,
+	}
+}
+
+// WithAuthServices returns the list with a service added for every mount point
+// that uses an authorization service
+func (list ServiceList) WithAuthServices() *ServiceList {
+	all := append(ServiceList{}, list...)
+	for _, s := range list {
+		if auth := s.AuthService(); auth != nil {
+			all = append(all, auth)
+		}
+	}
+	return &all
+}
+
+// NewAuthRequestHandler asks auth, normally the reverse proxy for the
+// service's AuthService, about each request. A 2xx answer lets the request
+// through and anything else is sent back to the client.
+func NewAuthRequestHandler(s Service, auth http.Handler, handler http.Handler) http.Handler {
+	if !s.AuthRequest.enabled() || auth == nil {
+		return handler
+	}
+	config := s.AuthRequest
+	if config.Timeout.Duration == 0 {
+		config.Timeout.Duration = 5 * time.Second
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range config.ResponseHeaders {
+			r.Header.Del(name)
+		}
+
+		ctx, cancel := context.WithTimeout(subrequestContext(r.Context()), config.Timeout.Duration)
+		defer cancel()
+		res := newRecordingWriter(newDiscardWriter(), maxAuthResponseSize)
+		auth.ServeHTTP(res, authSubrequest(ctx, s, config, r))
+		if res.status == 0 {
+			res.status = http.StatusOK
+		}
+
+		if res.status < http.StatusOK || res.status >= http.StatusMultipleChoices {
+			log.WithFields(log.Fields{"url": r.URL.Path,
+				"request_id":     requestIDFrom(r),
+				"remote_address": r.RemoteAddr,
+				"client_ip":      clientIP(r),
+				"auth_service":   config.Service,
+				"status":         res.status,
+			}).Info("Request denied by auth service")
+			if !res.Complete() {
+				res.header.Del("Content-Length")
+			}
+			res.Replay(w)
+			return
+		}
+		for _, name := range config.ResponseHeaders {
+			if values := res.header.Values(name); len(values) > 0 {
+				r.Header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// authSubrequest copies the request's method, path and headers, but not its
+// body, into a request for the authorization service
+func authSubrequest(ctx context.Context, s Service, config AuthRequestConfig, r *http.Request) *http.Request {
+	sub := r.Clone(ctx)
+	sub.Body = http.NoBody
+	sub.ContentLength = 0
+	sub.TransferEncoding = nil
+	// Upgrades are for the node, not the authorization service
+	for _, name := range []string{"Content-Length", "Transfer-Encoding", "Expect", "Connection", "Upgrade"} {
+		sub.Header.Del(name)
+	}
+	sub.Header.Set("X-Original-Method", r.Method)
+	sub.Header.Set("X-Original-URI", r.URL.RequestURI())
+	if config.Path != "" {
+		sub.URL.Path = s.MountPoint + config.Path
+		sub.URL.RawPath = ""
+		sub.URL.RawQuery = ""
+	}
+	return sub
+}
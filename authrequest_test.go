@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newAuthRequestTest serves /orders from a backend, asking authz first. It
+// returns the handler and what the backend saw.
+func newAuthRequestTest(t *testing.T, c AuthRequestConfig, authz http.HandlerFunc) (http.Handler, *http.Request, func()) {
+	var mu sync.Mutex
+	got := &http.Request{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*got = *r.Clone(r.Context())
+		mu.Unlock()
+		io.WriteString(w, "order 1")
+	}))
+	authServer := httptest.NewServer(authz)
+
+	s := serviceForTestServer("orders", "/orders", backend)
+	s.AuthRequest = c
+	auth := s.AuthService()
+	auth.Nodes = serviceForTestServer(c.Service, "/orders", authServer).Nodes
+	proxy, stopProxy := newTestProxy(t, s)
+	authProxy, stopAuth := newTestProxy(t, *auth)
+	handler := NewServiceHandler(s, proxy, authProxy, NewUpgradeTracker(), nil, NewFaults(), NewAccess())
+	return handler, got, func() {
+		stopProxy()
+		stopAuth()
+		backend.Close()
+		authServer.Close()
+	}
+}
+
+func TestAuthRequestAllowed(t *testing.T) {
+	var asked *http.Request
+	var askedBody string
+	handler, got, stop := newAuthRequestTest(t, AuthRequestConfig{Service: "authz",
+		ResponseHeaders: []string{"X-User-Id"}}, func(w http.ResponseWriter, r *http.Request) {
+		asked = r.Clone(r.Context())
+		body, _ := io.ReadAll(r.Body)
+		askedBody = string(body)
+		w.Header().Set("X-User-Id", "user-42")
+		w.Header().Set("X-Other", "not copied")
+	})
+	defer stop()
+
+	r := httptest.NewRequest("POST", "/orders/1?expand=items", strings.NewReader(`{"quantity": 2}`))
+	r.Header.Set("Authorization", "Bearer abc")
+	r.Header.Set("X-User-Id", "spoofed")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+
+	if res.Code != http.StatusOK || res.Body.String() != "order 1" {
+		t.Fatalf("Expected the request to be proxied but got %d %s", res.Code, res.Body.String())
+	}
+	if asked.Method != "POST" || asked.URL.Path != "/1" || asked.URL.RawQuery != "expand=items" {
+		t.Errorf("Expected the auth service to be asked about POST /1?expand=items but got %s %s",
+			asked.Method, asked.URL.RequestURI())
+	}
+	if asked.Header.Get("Authorization") != "Bearer abc" || asked.Header.Get("X-Original-URI") != "/orders/1?expand=items" {
+		t.Errorf("Expected the client's headers to be passed on but got %v", asked.Header)
+	}
+	if askedBody != "" {
+		t.Errorf("Expected the body to stay with the request but the auth service got '%s'", askedBody)
+	}
+	if got.Header.Get("X-User-Id") != "user-42" || got.Header.Get("X-Other") != "" {
+		t.Errorf("Expected only the configured header from the auth service but got %v", got.Header)
+	}
+}
+
+func TestAuthRequestDenied(t *testing.T) {
+	handler, got, stop := newAuthRequestTest(t, AuthRequestConfig{Service: "authz", Path: "/check"},
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/check" || r.Header.Get("X-Original-Method") != "DELETE" {
+				t.Errorf("Expected DELETE to be checked at /check but got %s at %s",
+					r.Header.Get("X-Original-Method"), r.URL.Path)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="orders"`)
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"error":"forbidden"}`)
+		})
+	defer stop()
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("DELETE", "/orders/1", nil))
+	if res.Code != http.StatusForbidden || res.Body.String() != `{"error":"forbidden"}` ||
+		res.Header().Get("WWW-Authenticate") != `Basic realm="orders"` {
+		t.Errorf("Expected the auth service's answer but got %d %v %s", res.Code, res.Header(), res.Body.String())
+	}
+	if got.Method != "" {
+		t.Errorf("Expected the backend not to be asked but it got %s %s", got.Method, got.URL)
+	}
+}
+
+func TestAuthRequestServiceDown(t *testing.T) {
+	handler, got, stop := newAuthRequestTest(t, AuthRequestConfig{Service: "authz"},
+		func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		})
+	defer stop()
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/orders/1", nil))
+	if res.Code != http.StatusBadGateway {
+		t.Errorf("Expected a 502 when the auth service fails but got %d %s", res.Code, res.Body.String())
+	}
+	if got.Method != "" {
+		t.Errorf("Expected the backend not to be asked but it got %s %s", got.Method, got.URL)
+	}
+}
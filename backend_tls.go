@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// DefaultBackendTLSTag marks nodes in Consul that should be reached over TLS
+const DefaultBackendTLSTag = "https"
+
+// DefaultBackendH2CTag marks nodes in Consul that speak HTTP/2 without TLS
+const DefaultBackendH2CTag = "h2c"
+
+// DefaultBackendProxyProtocolTag marks nodes in Consul that expect a PROXY
+// protocol header
+const DefaultBackendProxyProtocolTag = "proxy-protocol"
+
+// BackendConfig controls how conductor talks to the nodes of a service
+type BackendConfig struct {
+	// Reach every node over TLS
+	TLS bool `json:"tls"`
+	// Reach nodes carrying this Consul tag over TLS. Defaults to "https".
+	TLSTag string `json:"tls_tag"`
+	// PEM bundle of CAs to verify nodes with instead of the system roots
+	CAFile string `json:"ca_file"`
+	// Client certificate and key for nodes that require mutual TLS
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Verify nodes against this name and send it as SNI instead of the address
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// Speak HTTP/2 without TLS (prior knowledge h2c) to every plain HTTP node,
+	// or only to nodes carrying this Consul tag. Defaults to "h2c". Nodes
+	// reached over TLS use HTTP/2 whenever they offer it.
+	H2C    bool   `json:"h2c"`
+	H2CTag string `json:"h2c_tag"`
+	// Start connections to nodes carrying this Consul tag with a PROXY protocol
+	// header naming the client. Defaults to "proxy-protocol". The version, 1 or
+	// 2, defaults to 1.
+	ProxyProtocolTag     string `json:"proxy_protocol_tag"`
+	ProxyProtocolVersion int    `json:"proxy_protocol_version"`
+}
+
+// SchemeFor returns the URL scheme to use when proxying to a node. The "h2c"
+// scheme is handled by the transport from NewBackendTransport. gRPC always
+// needs HTTP/2 so plain gRPC nodes get h2c. Nodes that expect PROXY protocol
+// get "proxy+" in front.
+func (s Service) SchemeFor(n Node) string {
+	scheme := "http"
+	if s.Backend.TLS || hasTag(n, s.Backend.TLSTag, DefaultBackendTLSTag) {
+		scheme = "https"
+	} else if s.Backend.H2C || s.Type == ServiceTypeGRPC || hasTag(n, s.Backend.H2CTag, DefaultBackendH2CTag) {
+		scheme = "h2c"
+	}
+	if hasTag(n, s.Backend.ProxyProtocolTag, DefaultBackendProxyProtocolTag) {
+		return proxyProtocolSchemePrefix + scheme
+	}
+	return scheme
+}
+
+func hasTag(n Node, tag, defaultTag string) bool {
+	if tag == "" {
+		tag = defaultTag
+	}
+	for _, t := range n.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// NewBackendTLSConfig builds the client side TLS configuration for a service
+func NewBackendTLSConfig(b BackendConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         b.ServerName,
+		InsecureSkipVerify: b.InsecureSkipVerify,
+	}
+
+	if b.CAFile != "" {
+		bundle, err := ioutil.ReadFile(b.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in CA file '%s'", b.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if b.CertFile != "" || b.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(b.CertFile, b.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// NewBackendTransport returns the transport the reverse proxy uses for a service
+func NewBackendTransport(b BackendConfig) (*http.Transport, error) {
+	if b.ProxyProtocolVersion < 0 || b.ProxyProtocolVersion > 2 {
+		return nil, fmt.Errorf("unknown PROXY protocol version %d", b.ProxyProtocolVersion)
+	}
+	tlsConfig, err := NewBackendTLSConfig(b)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.RegisterProtocol("h2c", NewH2CTransport())
+	proxied := NewProxyProtocolTransport(transport, b.ProxyProtocolVersion)
+	for _, scheme := range []string{"http", "https", "h2c"} {
+		transport.RegisterProtocol(proxyProtocolSchemePrefix+scheme, proxied)
+	}
+	return transport, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSchemeFor(t *testing.T) {
+	plain := Node{Name: "a", Address: "10.0.0.1", Port: 80}
+	tagged := Node{Name: "b", Address: "10.0.0.2", Port: 443, Tags: []string{"v1", "https"}}
+
+	s := Service{Name: "api"}
+	if s.SchemeFor(plain) != "http" {
+		t.Errorf("Expected untagged node to use http but got '%s'", s.SchemeFor(plain))
+	}
+	if s.SchemeFor(tagged) != "https" {
+		t.Errorf("Expected node tagged https to use https but got '%s'", s.SchemeFor(tagged))
+	}
+
+	s.Backend.TLSTag = "tls"
+	if s.SchemeFor(tagged) != "http" {
+		t.Errorf("Expected a custom tag to replace the default but got '%s'", s.SchemeFor(tagged))
+	}
+
+	s.Backend.TLS = true
+	if s.SchemeFor(plain) != "https" {
+		t.Errorf("Expected every node to use https but got '%s'", s.SchemeFor(plain))
+	}
+}
+
+func TestProxyToMutualTLSBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conductor-backend-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCertPEM, serverKeyPEM := generateCertificate(t, "backend.internal")
+	clientCertPEM, clientKeyPEM := generateCertificate(t, "conductor")
+	files := map[string][]byte{
+		"ca.pem":         serverCertPEM,
+		"client.pem":     clientCertPEM,
+		"client-key.pem": clientKeyPEM,
+	}
+	for name, contents := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), contents, 0600)
+	}
+
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCertPEM)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName + " " + r.URL.Path))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	s := Service{Name: "secure",
+		MountPoint: "/secure",
+		Nodes:      []Node{Node{Name: "secure1", Address: host, Port: portNumber}},
+		Backend: BackendConfig{
+			TLS:        true,
+			CAFile:     filepath.Join(dir, "ca.pem"),
+			CertFile:   filepath.Join(dir, "client.pem"),
+			KeyFile:    filepath.Join(dir, "client-key.pem"),
+			ServerName: "backend.internal",
+		},
+	}
+
+	w := NewLoadBalancerWorker(NewNiaveRoundRobin)
+	go w.Work(s)
+	defer func() { w.ControlChan <- true }()
+
+	transport, err := NewBackendTransport(s.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(NewReverseProxyWithLoadBalancer(s, w.RequestChan, transport))
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/secure/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || string(body) != "conductor /hello" {
+		t.Errorf("Expected 200 'conductor /hello' but got %d '%s'", res.StatusCode, body)
+	}
+}
+
+func TestNewBackendTLSConfigWithMissingCA(t *testing.T) {
+	_, err := NewBackendTLSConfig(BackendConfig{CAFile: "/does/not/exist.pem"})
+	if err == nil {
+		t.Error("Expected an error for a missing CA file")
+	}
+}
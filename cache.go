@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig turns on an HTTP cache for a service's GET requests, eg
+// {"enabled": true, "max_size": "256MB", "disk_path": "/var/cache/conductor/api"}
+type CacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// Memory for cached responses. Defaults to 64MB.
+	MaxSize ByteSize `json:"max_size"`
+	// Bigger responses are passed through without being cached. Defaults to 1MB.
+	MaxObjectSize ByteSize `json:"max_object_size"`
+	// How long after a response expires it can still be served while a fresh
+	// copy is fetched in the background. The response's own
+	// stale-while-revalidate wins.
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+	// How long after a response expires it can still be served when the
+	// service has no healthy nodes or is failing. The response's own
+	// stale-if-error wins. Defaults to one hour.
+	StaleIfError Duration `json:"stale_if_error"`
+	// Keep responses on disk as well, so they outlive memory and restarts
+	DiskPath string `json:"disk_path"`
+	// Defaults to 1GB
+	DiskMaxSize ByteSize `json:"disk_max_size"`
+}
+
+// Responses with these statuses can be stored
+var cacheableStatus = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true, http.StatusPermanentRedirect: true,
+	http.StatusNotFound: true, http.StatusMethodNotAllowed: true, http.StatusGone: true,
+	http.StatusRequestURITooLong: true, http.StatusNotImplemented: true,
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	// When the response was generated upstream and when it stops being fresh
+	Stored               time.Time     `json:"stored"`
+	Expires              time.Time     `json:"expires"`
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate"`
+	StaleIfError         time.Duration `json:"stale_if_error"`
+	MustRevalidate       bool          `json:"must_revalidate"`
+	// Only set on the entry under the plain URL of a response with Vary. It
+	// points at the entries for each variant.
+	Vary []string `json:"vary,omitempty"`
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Body)) + 64
+	for k, values := range e.Header {
+		size += int64(len(k))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *cacheEntry) hasValidator() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// staleWithin reports whether the entry expired less than window ago and is
+// allowed to be served stale
+func (e *cacheEntry) staleWithin(now time.Time, window time.Duration) bool {
+	return !e.MustRevalidate && now.Before(e.Expires.Add(window))
+}
+
+// ResponseCache is an HTTP cache in front of a service. It follows
+// Cache-Control and Vary, revalidates with ETag and Last-Modified, and only
+// sends one request upstream for concurrent misses on the same URL.
+type ResponseCache struct {
+	service string
+	config  CacheConfig
+	store   cacheStore
+	handler http.Handler
+	flights *flightGroup
+	now     func() time.Time
+}
+
+// NewResponseCache sets up the cache with the defaults filled in. It fails if
+// the disk cache can't be opened.
+func NewResponseCache(service string, c CacheConfig, handler http.Handler) (*ResponseCache, error) {
+	if c.MaxSize == 0 {
+		c.MaxSize = 64 << 20
+	}
+	if c.MaxObjectSize == 0 {
+		c.MaxObjectSize = 1 << 20
+	}
+	if c.StaleIfError.Duration == 0 {
+		c.StaleIfError.Duration = time.Hour
+	}
+	if c.DiskMaxSize == 0 {
+		c.DiskMaxSize = 1 << 30
+	}
+
+	var store cacheStore = newMemoryCacheStore(int64(c.MaxSize))
+	if c.DiskPath != "" {
+		disk, err := newDiskCacheStore(c.DiskPath, int64(c.DiskMaxSize))
+		if err != nil {
+			return nil, err
+		}
+		store = &tieredCacheStore{memory: store, disk: disk}
+	}
+	return &ResponseCache{service: service, config: c, store: store, handler: handler,
+		flights: newFlightGroup(), now: time.Now}, nil
+}
+
+// NewCacheHandler puts a response cache in front of the service if its
+// definition asks for one. A disk cache that can't be opened falls back to
+// caching in memory.
+func NewCacheHandler(s Service, handler http.Handler) http.Handler {
+	if !s.Cache.Enabled {
+		return handler
+	}
+	if len(s.Split.Versions) > 0 {
+		// The key can't tell versions apart, so one version's responses would be
+		// served to clients of the others
+		log.WithFields(log.Fields{"service": s.Name}).Warn("Not caching responses on a mount point with a split")
+		return handler
+	}
+	cache, err := NewResponseCache(s.Name, s.Cache, handler)
+	if err != nil {
+		log.WithFields(log.Fields{"service": s.Name,
+			"disk_path": s.Cache.DiskPath,
+			"error":     err}).Error("Could not open disk cache, caching in memory only")
+		c := s.Cache
+		c.DiskPath = ""
+		cache, _ = NewResponseCache(s.Name, c, handler)
+	}
+	return cache
+}
+
+func (c *ResponseCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestCC := parseCacheControl(r.Header)
+	if _, noStore := requestCC["no-store"]; noStore || !isCacheableRequest(r) {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+
+	key := r.URL.RequestURI()
+	_, noCache := requestCC["no-cache"]
+	revalidate := noCache || requestCC["max-age"] == "0"
+	entry := c.lookup(key, r)
+	if entry != nil && !revalidate {
+		now := c.now()
+		if entry.fresh(now) {
+			c.serve(w, r, entry, "HIT")
+			return
+		}
+		if entry.staleWithin(now, entry.StaleWhileRevalidate) {
+			go c.refresh(key, r.Clone(detachContext(r.Context())), entry)
+			c.serve(w, r, entry, "STALE")
+			return
+		}
+	}
+
+	f, leader := c.flights.join(key)
+	if !leader {
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return
+		}
+		// A response for another variant doesn't help us
+		if entry := c.lookup(key, r); entry != nil && entry.fresh(c.now()) {
+			c.serve(w, r, entry, "HIT")
+			return
+		}
+		c.fetch(w, r, key, entry)
+		return
+	}
+	defer c.flights.finish(key, f)
+	c.fetch(w, r, key, entry)
+}
+
+// isCacheableRequest leaves out anything a shared cache shouldn't answer
+func isCacheableRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && !IsUpgradeRequest(r) && !IsGRPCRequest(r) &&
+		r.Header.Get("Authorization") == "" && r.Header.Get("Range") == ""
+}
+
+// lookup finds the entry for the request, following Vary to the right variant.
+// Entries too old to be any use are treated as missing.
+func (c *ResponseCache) lookup(key string, r *http.Request) *cacheEntry {
+	entry := c.store.Get(key)
+	if entry != nil && len(entry.Vary) > 0 {
+		entry = c.store.Get(variantKey(key, entry.Vary, r))
+	}
+	if entry == nil {
+		return nil
+	}
+	now := c.now()
+	if !entry.hasValidator() && !entry.staleWithin(now, entry.StaleWhileRevalidate) &&
+		!entry.staleWithin(now, entry.StaleIfError) {
+		return nil
+	}
+	return entry
+}
+
+// refresh revalidates a stale entry in the background
+func (c *ResponseCache) refresh(key string, r *http.Request, entry *cacheEntry) {
+	f, leader := c.flights.join(key)
+	if !leader {
+		return
+	}
+	defer c.flights.finish(key, f)
+	// Another refresh may have finished since we were started
+	if current := c.lookup(key, r); current != nil && current.fresh(c.now()) {
+		return
+	}
+	c.fetch(newDiscardWriter(), r, key, entry)
+}
+
+// fetch asks the service for the response and stores it. With an entry the
+// request is made conditional, and a 304 or a failure that a stale entry can
+// cover is answered from the cache.
+func (c *ResponseCache) fetch(w http.ResponseWriter, r *http.Request, key string, entry *cacheEntry) {
+	upstream := r.Clone(r.Context())
+	upstream.Header.Del("If-None-Match")
+	upstream.Header.Del("If-Modified-Since")
+	if entry != nil {
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			upstream.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			upstream.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	now := c.now()
+	cw := &cacheWriter{client: w, header: make(http.Header), limit: int64(c.config.MaxObjectSize)}
+	cw.passThrough = func(status int) bool {
+		if entry == nil {
+			return true
+		}
+		if status == http.StatusNotModified {
+			return false
+		}
+		return !(isUpstreamFailure(status) && entry.staleWithin(now, entry.StaleIfError))
+	}
+	c.handler.ServeHTTP(cw, upstream)
+
+	switch {
+	case cw.passed:
+		c.storeResponse(key, r, cw, now)
+	case cw.status == http.StatusNotModified:
+		updated := *entry
+		updated.Header = entry.Header.Clone()
+		for k, v := range cw.header {
+			if k != "Content-Length" {
+				updated.Header[k] = v
+			}
+		}
+		c.setFreshness(&updated, now)
+		c.save(key, r, &updated)
+		c.serve(w, r, &updated, "REVALIDATED")
+	case cw.status != 0:
+		log.WithFields(log.Fields{"service": c.service,
+			"url":    r.URL.Path,
+			"status": cw.status}).Warn("Service failed, serving stale response")
+		c.serve(w, r, entry, "STALE")
+	}
+}
+
+func isUpstreamFailure(status int) bool {
+	return status == http.StatusInternalServerError || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// storeResponse saves a response from upstream if it is allowed to be cached
+func (c *ResponseCache) storeResponse(key string, r *http.Request, cw *cacheWriter, now time.Time) {
+	if cw.truncated || !cacheableStatus[cw.Status()] {
+		return
+	}
+	cc := parseCacheControl(cw.header)
+	_, noStore := cc["no-store"]
+	_, private := cc["private"]
+	if noStore || private || cw.header.Get("Set-Cookie") != "" {
+		return
+	}
+
+	entry := &cacheEntry{Status: cw.Status(), Header: cw.header.Clone(), Body: cw.body.Bytes()}
+	c.setFreshness(entry, now)
+	if !entry.fresh(now) && !entry.hasValidator() {
+		return
+	}
+	c.save(key, r, entry)
+}
+
+// save stores the entry under the request's URL, or under its variant if the
+// response varies by request headers
+func (c *ResponseCache) save(key string, r *http.Request, entry *cacheEntry) {
+	vary := varyHeaders(entry.Header)
+	if len(vary) == 0 {
+		c.store.Set(key, entry)
+		return
+	}
+	for _, name := range vary {
+		if name == "*" {
+			return
+		}
+	}
+	c.store.Set(key, &cacheEntry{Vary: vary})
+	c.store.Set(variantKey(key, vary, r), entry)
+}
+
+// setFreshness works out when an entry expires and how long it can be served
+// stale from its headers and our configuration
+func (c *ResponseCache) setFreshness(e *cacheEntry, now time.Time) {
+	cc := parseCacheControl(e.Header)
+	var lifetime time.Duration
+	if seconds, ok := cacheControlSeconds(cc, "s-maxage"); ok {
+		lifetime = seconds
+	} else if seconds, ok := cacheControlSeconds(cc, "max-age"); ok {
+		lifetime = seconds
+	} else if expires, err := http.ParseTime(e.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(e.Header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		lifetime = expires.Sub(date)
+	}
+	if _, noCache := cc["no-cache"]; noCache {
+		lifetime = 0
+	}
+
+	// The response may have sat in another cache before it got to us
+	e.Stored = now
+	if age, err := strconv.Atoi(e.Header.Get("Age")); err == nil && age > 0 {
+		e.Stored = now.Add(-time.Duration(age) * time.Second)
+	}
+	e.Header.Del("Age")
+	e.Expires = e.Stored.Add(lifetime)
+
+	e.StaleWhileRevalidate = c.config.StaleWhileRevalidate.Duration
+	if seconds, ok := cacheControlSeconds(cc, "stale-while-revalidate"); ok {
+		e.StaleWhileRevalidate = seconds
+	}
+	e.StaleIfError = c.config.StaleIfError.Duration
+	if seconds, ok := cacheControlSeconds(cc, "stale-if-error"); ok {
+		e.StaleIfError = seconds
+	}
+	_, mustRevalidate := cc["must-revalidate"]
+	_, proxyRevalidate := cc["proxy-revalidate"]
+	e.MustRevalidate = mustRevalidate || proxyRevalidate
+}
+
+// serve answers the request from an entry, with a 304 if the client's copy is
+// still good
+func (c *ResponseCache) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry, cacheStatus string) {
+	header := w.Header()
+	for k, v := range e.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	age := c.now().Sub(e.Stored)
+	if age < 0 {
+		age = 0
+	}
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	header.Set("X-Cache", cacheStatus)
+
+	if e.Status == http.StatusOK && notModified(r, e) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.Status)
+	w.Write(e.Body)
+}
+
+// notModified checks the client's conditional headers against the entry
+func notModified(r *http.Request, e *cacheEntry) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+// parseCacheControl splits Cache-Control into lower case directives and their
+// values, eg {"max-age": "60", "public": ""}
+func parseCacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func cacheControlSeconds(cc map[string]string, directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// varyHeaders returns the sorted, canonical header names a response varies by
+func varyHeaders(h http.Header) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func variantKey(key string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ": " + strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// cacheWriter collects a response from upstream for the cache. Once the status
+// is known passThrough decides whether it also goes to the client.
+type cacheWriter struct {
+	client      http.ResponseWriter
+	header      http.Header
+	status      int
+	passThrough func(status int) bool
+	passed      bool
+	body        bytes.Buffer
+	limit       int64
+	truncated   bool
+}
+
+func (w *cacheWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	// Informational responses aren't worth keeping
+	if w.status != 0 || status < http.StatusOK {
+		return
+	}
+	w.status = status
+	w.passed = w.passThrough(status)
+	if w.passed {
+		header := w.client.Header()
+		for k, v := range w.header {
+			header[k] = v
+		}
+		header.Set("X-Cache", "MISS")
+		w.client.WriteHeader(status)
+	}
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.truncated {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.truncated = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	if w.passed {
+		return w.client.Write(b)
+	}
+	return len(b), nil
+}
+
+func (w *cacheWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *cacheWriter) Flush() {
+	if w.passed {
+		http.NewResponseController(w.client).Flush()
+	}
+}
+
+// discardWriter is a ResponseWriter for requests nobody is waiting on
+type discardWriter struct {
+	header http.Header
+}
+
+func newDiscardWriter() *discardWriter {
+	return &discardWriter{header: make(http.Header)}
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) WriteHeader(int)             {}
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+// flightGroup lets one request do the work for a key while identical requests
+// wait for it to finish
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done    chan struct{}
+	waiters int
+	// What the leader got, for coalesced requests
+	response *recordingWriter
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// join returns the flight for key and whether the caller is leading it. The
+// leader has to call finish.
+func (g *flightGroup) join(key string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+func (g *flightGroup) finish(key string, f *flight) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// cacheStore holds cache entries by key, evicting the least recently used
+// entries to stay under its size limit
+type cacheStore interface {
+	Get(key string) *cacheEntry
+	Set(key string, entry *cacheEntry)
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *cacheEntry
+	size  int64
+}
+
+type memoryCacheStore struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	lru     *list.List
+}
+
+func newMemoryCacheStore(maxSize int64) *memoryCacheStore {
+	return &memoryCacheStore{maxSize: maxSize, items: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (m *memoryCacheStore) Get(key string) *cacheEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil
+	}
+	m.lru.MoveToFront(el)
+	return el.Value.(*memoryCacheItem).entry
+}
+
+func (m *memoryCacheStore) Set(key string, entry *cacheEntry) {
+	size := entry.size()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+	if size > m.maxSize {
+		return
+	}
+	m.items[key] = m.lru.PushFront(&memoryCacheItem{key: key, entry: entry, size: size})
+	m.size += size
+	for m.size > m.maxSize {
+		m.remove(m.lru.Back().Value.(*memoryCacheItem).key)
+	}
+}
+
+func (m *memoryCacheStore) remove(key string) {
+	if el, ok := m.items[key]; ok {
+		m.size -= el.Value.(*memoryCacheItem).size
+		m.lru.Remove(el)
+		delete(m.items, key)
+	}
+}
+
+// diskCacheFile is what goes in each file. The key is kept to rule out hash
+// collisions.
+type diskCacheFile struct {
+	Key   string      `json:"key"`
+	Entry *cacheEntry `json:"entry"`
+}
+
+type diskCacheItem struct {
+	name string
+	size int64
+}
+
+// diskCacheStore keeps each entry in its own file named by a hash of the key.
+// Files left by an earlier run are picked up again, oldest first in line for
+// eviction.
+type diskCacheStore struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	lru     *list.List
+}
+
+func newDiskCacheStore(dir string, maxSize int64) (*diskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type existing struct {
+		diskCacheItem
+		modified int64
+	}
+	var found []existing
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, existing{diskCacheItem{f.Name(), info.Size()}, info.ModTime().UnixNano()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modified < found[j].modified })
+
+	d := &diskCacheStore{dir: dir, maxSize: maxSize, items: make(map[string]*list.Element), lru: list.New()}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, f := range found {
+		item := f.diskCacheItem
+		d.items[item.name] = d.lru.PushFront(&item)
+		d.size += item.size
+	}
+	d.evict()
+	return d, nil
+}
+
+func (d *diskCacheStore) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+func (d *diskCacheStore) Get(key string) *cacheEntry {
+	name := d.fileName(key)
+	d.mu.Lock()
+	el, ok := d.items[name]
+	if ok {
+		d.lru.MoveToFront(el)
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		d.Delete(key)
+		return nil
+	}
+	var file diskCacheFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Key != key || file.Entry == nil {
+		return nil
+	}
+	return file.Entry
+}
+
+func (d *diskCacheStore) Set(key string, entry *cacheEntry) {
+	data, err := json.Marshal(diskCacheFile{Key: key, Entry: entry})
+	if err != nil || int64(len(data)) > d.maxSize {
+		return
+	}
+	name := d.fileName(key)
+	path := filepath.Join(d.dir, name)
+	// Write then rename so a reader never sees half a file
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		log.WithFields(log.Fields{"path": path, "error": err}).Warn("Could not write to disk cache")
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.WithFields(log.Fields{"path": path, "error": err}).Warn("Could not write to disk cache")
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.items[name]; ok {
+		d.size -= el.Value.(*diskCacheItem).size
+		d.lru.Remove(el)
+	}
+	d.items[name] = d.lru.PushFront(&diskCacheItem{name: name, size: int64(len(data))})
+	d.size += int64(len(data))
+	d.evict()
+}
+
+func (d *diskCacheStore) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(d.fileName(key))
+}
+
+func (d *diskCacheStore) evict() {
+	for d.size > d.maxSize {
+		d.remove(d.lru.Back().Value.(*diskCacheItem).name)
+	}
+}
+
+func (d *diskCacheStore) remove(name string) {
+	if el, ok := d.items[name]; ok {
+		d.size -= el.Value.(*diskCacheItem).size
+		d.lru.Remove(el)
+		delete(d.items, name)
+		os.Remove(filepath.Join(d.dir, name))
+	}
+}
+
+// tieredCacheStore keeps recently used entries in memory in front of the disk
+type tieredCacheStore struct {
+	memory cacheStore
+	disk   cacheStore
+}
+
+func (t *tieredCacheStore) Get(key string) *cacheEntry {
+	if entry := t.memory.Get(key); entry != nil {
+		return entry
+	}
+	entry := t.disk.Get(key)
+	if entry != nil {
+		t.memory.Set(key, entry)
+	}
+	return entry
+}
+
+func (t *tieredCacheStore) Set(key string, entry *cacheEntry) {
+	t.memory.Set(key, entry)
+	t.disk.Set(key, entry)
+}
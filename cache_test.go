@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCache puts a cache with a fake clock in front of handler
+func newTestCache(t *testing.T, c CacheConfig, handler http.HandlerFunc) (*ResponseCache, *time.Time) {
+	cache, err := NewResponseCache("api", c, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000000, 0)
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+func cacheGet(handler http.Handler, path string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+	return res
+}
+
+func TestCacheHonoursMaxAge(t *testing.T) {
+	var calls int32
+	cache, now := newTestCache(t, CacheConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "response %d", n)
+	})
+
+	cacheGet(cache, "/api/users?page=1")
+	*now = now.Add(30 * time.Second)
+	res := cacheGet(cache, "/api/users?page=1")
+	if res.Body.String() != "response 1" || res.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected a cache hit but got '%s' (%s)", res.Body.String(), res.Header().Get("X-Cache"))
+	}
+	if res.Header().Get("Age") != "30" {
+		t.Errorf("Expected Age: 30 but got '%s'", res.Header().Get("Age"))
+	}
+
+	if res := cacheGet(cache, "/api/users?page=2"); res.Body.String() != "response 2" {
+		t.Errorf("Expected a different query to miss but got '%s'", res.Body.String())
+	}
+
+	*now = now.Add(31 * time.Second)
+	if res := cacheGet(cache, "/api/users?page=1"); res.Body.String() != "response 3" {
+		t.Errorf("Expected an expired response to be fetched again but got '%s'", res.Body.String())
+	}
+}
+
+func TestCacheSkipsUncacheableResponses(t *testing.T) {
+	tests := map[string]func(w http.ResponseWriter){
+		"no-store": func(w http.ResponseWriter) { w.Header().Set("Cache-Control", "no-store, max-age=60") },
+		"private":  func(w http.ResponseWriter) { w.Header().Set("Cache-Control", "private, max-age=60") },
+		"set-cookie": func(w http.ResponseWriter) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "a=b")
+		},
+		"no-freshness": func(w http.ResponseWriter) {},
+		"server-error": func(w http.ResponseWriter) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	}
+	for name, respond := range tests {
+		calls := 0
+		cache, _ := newTestCache(t, CacheConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			respond(w)
+		})
+		cacheGet(cache, "/api/users")
+		cacheGet(cache, "/api/users")
+		if calls != 2 {
+			t.Errorf("%s: expected both requests to reach the service but it saw %d", name, calls)
+		}
+	}
+
+	calls := 0
+	cache, _ := newTestCache(t, CacheConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	cacheGet(cache, "/api/users", "Authorization", "Bearer abc")
+	cacheGet(cache, "/api/users", "Authorization", "Bearer abc")
+	if calls != 2 {
+		t.Errorf("Expected authorized requests to bypass the cache but the service saw %d", calls)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	calls := 0
+	cache, _ := newTestCache(t, CacheConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	})
+
+	cacheGet(cache, "/api/greeting", "Accept-Language", "en")
+	cacheGet(cache, "/api/greeting", "Accept-Language", "fr")
+	en := cacheGet(cache, "/api/greeting", "Accept-Language", "en")
+	fr := cacheGet(cache, "/api/greeting", "Accept-Language", "fr")
+	if en.Body.String() != "en" || fr.Body.String() != "fr" {
+		t.Errorf("Expected each language to get its own response but got '%s' and '%s'", en.Body.String(), fr.Body.String())
+	}
+	if calls != 2 {
+		t.Errorf("Expected one request per language to reach the service but it saw %d", calls)
+	}
+}
+
+func TestCacheRevalidates(t *testing.T) {
+	var conditional string
+	calls := 0
+	cache, now := newTestCache(t, CacheConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		conditional = r.Header.Get("If-None-Match")
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+		if conditional == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "version one")
+	})
+
+	cacheGet(cache, "/api/users")
+	*now = now.Add(20 * time.Second)
+	res := cacheGet(cache, "/api/users")
+	if conditional != `"v1"` {
+		t.Errorf("Expected the service to be asked with If-None-Match but got '%s'", conditional)
+	}
+	if res.Code != http.StatusOK || res.Body.String() != "version one" || res.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("Expected the cached body after a 304 but got %d '%s' (%s)", res.Code, res.Body.String(), res.Header().Get("X-Cache"))
+	}
+
+	*now = now.Add(5 * time.Second)
+	res = cacheGet(cache, "/api/users", "If-None-Match", `"v1"`)
+	if res.Code != http.StatusNotModified || res.Body.Len() != 0 {
+		t.Errorf("Expected the client's copy to be confirmed with a 304 but got %d", res.Code)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the revalidated response to be fresh again but the service saw %d requests", calls)
+	}
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	var calls int32
+	release := make(chan bool)
+	cache, _ := newTestCache(t, CacheConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "slow")
+	})
+
+	var wg sync.WaitGroup
+	bodies := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies <- cacheGet(cache, "/api/slow").Body.String()
+		}()
+	}
+	waitFor(t, func() bool {
+		cache.flights.mu.Lock()
+		defer cache.flights.mu.Unlock()
+		f := cache.flights.flights["/api/slow"]
+		return f != nil && f.waiters == 4
+	})
+	close(release)
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		if body != "slow" {
+			t.Errorf("Expected every request to get the response but got '%s'", body)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("Expected one request to reach the service but it saw %d", calls)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var calls int32
+	cache, now := newTestCache(t, CacheConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=60")
+		fmt.Fprintf(w, "response %d", n)
+	})
+
+	cacheGet(cache, "/api/users")
+	*now = now.Add(20 * time.Second)
+	res := cacheGet(cache, "/api/users")
+	if res.Body.String() != "response 1" || res.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("Expected the stale response straight away but got '%s' (%s)", res.Body.String(), res.Header().Get("X-Cache"))
+	}
+	waitFor(t, func() bool { return cacheGet(cache, "/api/users").Body.String() == "response 2" })
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("Expected a single background refresh but the service saw %d requests", calls)
+	}
+}
+
+func TestCacheServesStaleWithNoHealthyNodes(t *testing.T) {
+	down := false
+	cache, now := newTestCache(t, CacheConfig{StaleIfError: Duration{time.Minute}}, func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			noHealthyBackends(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=10")
+		fmt.Fprint(w, "last known good")
+	})
+
+	cacheGet(cache, "/api/users")
+	down = true
+	*now = now.Add(30 * time.Second)
+	res := cacheGet(cache, "/api/users")
+	if res.Code != http.StatusOK || res.Body.String() != "last known good" || res.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("Expected the stale response but got %d '%s'", res.Code, res.Body.String())
+	}
+
+	*now = now.Add(time.Minute)
+	if res := cacheGet(cache, "/api/users"); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 once the response is too stale but got %d", res.Code)
+	}
+}
+
+func TestCacheSkipsLargeResponses(t *testing.T) {
+	calls := 0
+	cache, _ := newTestCache(t, CacheConfig{MaxObjectSize: 10}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "more than ten bytes")
+	})
+	cacheGet(cache, "/api/big")
+	if res := cacheGet(cache, "/api/big"); res.Body.String() != "more than ten bytes" || calls != 2 {
+		t.Errorf("Expected large responses to be passed through uncached but got '%s' after %d calls", res.Body.String(), calls)
+	}
+}
+
+func TestMemoryCacheStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	entry := func() *cacheEntry { return &cacheEntry{Body: make([]byte, 100)} }
+	store := newMemoryCacheStore(3 * entry().size())
+	store.Set("a", entry())
+	store.Set("b", entry())
+	store.Set("c", entry())
+	store.Get("a")
+	store.Set("d", entry())
+
+	if store.Get("b") != nil {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if store.Get(key) == nil {
+			t.Errorf("Expected '%s' to still be cached", key)
+		}
+	}
+}
+
+func TestDiskCacheStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newDiskCacheStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("/api/users", &cacheEntry{Status: http.StatusOK, Header: http.Header{"Etag": {`"v1"`}}, Body: []byte("users")})
+
+	store, err = newDiskCacheStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := store.Get("/api/users")
+	if entry == nil || string(entry.Body) != "users" || entry.Header.Get("ETag") != `"v1"` {
+		t.Fatalf("Expected the entry to be read back from disk but got %+v", entry)
+	}
+	if store.Get("/api/other") != nil {
+		t.Error("Expected a missing key to miss")
+	}
+
+	small, err := newDiskCacheStore(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.Get("/api/users") != nil {
+		t.Error("Expected files over the size limit to be evicted on startup")
+	}
+}
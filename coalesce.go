@@ -0,0 +1,127 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// CoalesceConfig shares one upstream request between identical GET requests
+// that arrive while it is in flight, eg
+// {"enabled": true, "headers": ["Accept", "Accept-Encoding", "Accept-Language"]}
+type CoalesceConfig struct {
+	Enabled bool `json:"enabled"`
+	// Request headers that have to match as well as the path and query.
+	// Defaults to Accept and Accept-Encoding.
+	Headers []string `json:"headers"`
+	// Responses bigger than this aren't shared, the waiting requests are sent
+	// upstream themselves. Defaults to 1MB.
+	MaxBodySize ByteSize `json:"max_body_size"`
+}
+
+var defaultCoalesceHeaders = []string{"Accept", "Accept-Encoding"}
+
+// KeyFor returns what a request has to match to share a response: the method,
+// the path as the service sees it, the query and the selected headers
+func (c CoalesceConfig) KeyFor(s Service, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + " " + s.RewritePath(r.URL.Path) + "?" + r.URL.RawQuery)
+	for _, name := range c.headerNames() {
+		b.WriteString("\n" + name + ": " + strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (c CoalesceConfig) headerNames() []string {
+	if len(c.Headers) == 0 {
+		return defaultCoalesceHeaders
+	}
+	return c.Headers
+}
+
+// canCoalesce leaves out requests that could get a response meant only for
+// them. Credentials only count if they are part of the key.
+func (c CoalesceConfig) canCoalesce(r *http.Request) bool {
+	if r.Method != http.MethodGet || IsUpgradeRequest(r) || IsGRPCRequest(r) {
+		return false
+	}
+	for _, private := range []string{"Authorization", "Cookie"} {
+		if r.Header.Get(private) == "" {
+			continue
+		}
+		keyed := false
+		for _, name := range c.headerNames() {
+			keyed = keyed || strings.EqualFold(name, private)
+		}
+		if !keyed {
+			return false
+		}
+	}
+	return true
+}
+
+// Coalescer sends the first of a group of identical GET requests upstream and
+// hands its response to the rest, singleflight style. Responses that set
+// cookies aren't shared.
+type Coalescer struct {
+	service Service
+	handler http.Handler
+	flights *flightGroup
+	limit   int64
+}
+
+func NewCoalescer(s Service, handler http.Handler) *Coalescer {
+	limit := int64(s.Coalesce.MaxBodySize)
+	if limit == 0 {
+		limit = 1 << 20
+	}
+	return &Coalescer{service: s, handler: handler, flights: newFlightGroup(), limit: limit}
+}
+
+// NewCoalesceHandler coalesces requests if the service definition asks for it
+func NewCoalesceHandler(s Service, handler http.Handler) http.Handler {
+	if !s.Coalesce.Enabled {
+		return handler
+	}
+	if len(s.Split.Versions) > 0 {
+		// The key can't tell versions apart, so clients would share responses
+		// across them
+		log.WithFields(log.Fields{"mount_point": s.MountPoint}).Warn("Not coalescing requests on a mount point with a split")
+		return handler
+	}
+	return NewCoalescer(s, handler)
+}
+
+func (c *Coalescer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !c.service.Coalesce.canCoalesce(r) {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+
+	key := c.service.Coalesce.KeyFor(c.service, r)
+	f, leader := c.flights.join(key)
+	if !leader {
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return
+		}
+		if f.response == nil {
+			c.handler.ServeHTTP(w, r)
+			return
+		}
+		f.response.Replay(w)
+		return
+	}
+
+	rw := newRecordingWriter(w, c.limit)
+	defer func() {
+		// A leader whose client went away only has a 499 to show for it, so the
+		// rest go upstream themselves
+		if rw.Complete() && rw.header.Get("Set-Cookie") == "" && r.Context().Err() == nil && rw.status != 499 {
+			f.response = rw
+		}
+		c.flights.finish(key, f)
+	}()
+	c.handler.ServeHTTP(rw, r)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCoalesceConfigKeyFor(t *testing.T) {
+	s := Service{Name: "api", MountPoint: "/api"}
+	c := CoalesceConfig{Headers: []string{"Accept"}}
+
+	r := httptest.NewRequest("GET", "/api/users?page=2", nil)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("User-Agent", "curl")
+	expected := "GET /users?page=2\nAccept: application/json"
+	if key := c.KeyFor(s, r); key != expected {
+		t.Errorf("Expected key '%s' but got '%s'", expected, key)
+	}
+}
+
+func TestCoalesceCanCoalesce(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	r.Header.Set("Authorization", "Bearer abc")
+	if (CoalesceConfig{}).canCoalesce(r) {
+		t.Error("Expected a request with credentials to go upstream on its own")
+	}
+	if !(CoalesceConfig{Headers: []string{"authorization"}}).canCoalesce(r) {
+		t.Error("Expected credentials in the key to allow coalescing")
+	}
+	if (CoalesceConfig{}).canCoalesce(httptest.NewRequest("POST", "/api/users", nil)) {
+		t.Error("Expected a POST not to be coalesced")
+	}
+}
+
+// coalesceConcurrently sends the requests at once and holds the upstream
+// until every one of them is either leading or waiting on a flight
+func coalesceConcurrently(t *testing.T, s Service, upstream http.HandlerFunc, requests []*http.Request) ([]*httptest.ResponseRecorder, int32) {
+	var calls int32
+	release := make(chan bool)
+	c := NewCoalescer(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		upstream(w, r)
+	}))
+
+	responses := make([]*httptest.ResponseRecorder, len(requests))
+	var wg sync.WaitGroup
+	for i, r := range requests {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(res *httptest.ResponseRecorder, r *http.Request) {
+			defer wg.Done()
+			c.ServeHTTP(res, r)
+		}(responses[i], r)
+	}
+	waitFor(t, func() bool {
+		c.flights.mu.Lock()
+		defer c.flights.mu.Unlock()
+		waiting := 0
+		for _, f := range c.flights.flights {
+			waiting += f.waiters + 1
+		}
+		return waiting == len(requests)
+	})
+	close(release)
+	wg.Wait()
+	return responses, atomic.LoadInt32(&calls)
+}
+
+func TestCoalesceSharesResponse(t *testing.T) {
+	s := Service{Name: "api", MountPoint: "/api", Coalesce: CoalesceConfig{Enabled: true}}
+	var requests []*http.Request
+	for i := 0; i < 5; i++ {
+		requests = append(requests, httptest.NewRequest("GET", "/api/deploy-status", nil))
+	}
+
+	responses, calls := coalesceConcurrently(t, s, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "shared")
+	}, requests)
+
+	if calls != 1 {
+		t.Errorf("Expected one request to reach the service but it saw %d", calls)
+	}
+	for _, res := range responses {
+		if res.Code != http.StatusAccepted || res.Body.String() != "shared" || res.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("Expected every client to get the shared response but got %d '%s'", res.Code, res.Body.String())
+		}
+	}
+}
+
+func TestCoalesceKeepsHeaderVariantsApart(t *testing.T) {
+	s := Service{Name: "api", MountPoint: "/api", Coalesce: CoalesceConfig{Enabled: true}}
+	var requests []*http.Request
+	for _, accept := range []string{"application/json", "text/html", "application/json"} {
+		r := httptest.NewRequest("GET", "/api/users", nil)
+		r.Header.Set("Accept", accept)
+		requests = append(requests, r)
+	}
+
+	responses, calls := coalesceConcurrently(t, s, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Accept"))
+	}, requests)
+
+	if calls != 2 {
+		t.Errorf("Expected one request per Accept header to reach the service but it saw %d", calls)
+	}
+	for i, res := range responses {
+		if res.Body.String() != requests[i].Header.Get("Accept") {
+			t.Errorf("Expected '%s' but got '%s'", requests[i].Header.Get("Accept"), res.Body.String())
+		}
+	}
+}
+
+func TestCoalesceDoesNotShareCookies(t *testing.T) {
+	s := Service{Name: "api", MountPoint: "/api", Coalesce: CoalesceConfig{Enabled: true}}
+	requests := []*http.Request{httptest.NewRequest("GET", "/api/login", nil), httptest.NewRequest("GET", "/api/login", nil)}
+
+	var sessions int32
+	responses, calls := coalesceConcurrently(t, s, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", fmt.Sprintf("session=%d", atomic.AddInt32(&sessions, 1)))
+	}, requests)
+
+	if calls != 2 {
+		t.Errorf("Expected each request to reach the service but it saw %d", calls)
+	}
+	if responses[0].Header().Get("Set-Cookie") == responses[1].Header().Get("Set-Cookie") {
+		t.Error("Expected each client to get its own cookie")
+	}
+}
+
+func TestCoalesceDoesNotShareCanceledLeader(t *testing.T) {
+	s := Service{Name: "api", MountPoint: "/api", Coalesce: CoalesceConfig{Enabled: true}}
+	var calls int32
+	release := make(chan bool)
+	c := NewCoalescer(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		if r.Context().Err() != nil {
+			// What proxyErrorHandler sends when the client goes away
+			w.WriteHeader(499)
+			return
+		}
+		fmt.Fprint(w, "fresh")
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := httptest.NewRequest("GET", "/api/deploy-status", nil).WithContext(ctx)
+	done := make(chan bool)
+	go func() {
+		c.ServeHTTP(httptest.NewRecorder(), leader)
+		close(done)
+	}()
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 1 })
+
+	follower := httptest.NewRecorder()
+	followed := make(chan bool)
+	go func() {
+		c.ServeHTTP(follower, httptest.NewRequest("GET", "/api/deploy-status", nil))
+		close(followed)
+	}()
+	waitFor(t, func() bool {
+		c.flights.mu.Lock()
+		defer c.flights.mu.Unlock()
+		for _, f := range c.flights.flights {
+			return f.waiters == 1
+		}
+		return false
+	})
+	cancel()
+	close(release)
+	<-done
+	<-followed
+
+	if follower.Code != http.StatusOK || follower.Body.String() != "fresh" {
+		t.Errorf("Expected the follower to go upstream itself but got %d '%s'", follower.Code, follower.Body.String())
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("Expected two requests to reach the service but it saw %d", calls)
+	}
+}
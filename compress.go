@@ -0,0 +1,281 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressionConfig compresses responses for clients that accept it, eg
+// {"enabled": true, "content_types": ["text/*", "application/json"], "min_size": "1KB"}
+type CompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Content types to compress. "text/*" matches every text type. Defaults
+	// to text, JSON, JavaScript, XML and SVG.
+	ContentTypes []string `json:"content_types"`
+	// Smaller responses aren't worth it. Defaults to 1KB.
+	MinSize ByteSize `json:"min_size"`
+	// 1 (fastest) to 9 (smallest). Defaults to 6.
+	GzipLevel int `json:"gzip_level"`
+	// 1 (fastest) to 11 (smallest). Defaults to 4.
+	BrotliLevel int `json:"brotli_level"`
+	// Encodings we offer, best first. Defaults to ["br", "gzip"].
+	Encodings []string `json:"encodings"`
+}
+
+var defaultCompressedTypes = []string{"text/*", "application/json", "application/javascript",
+	"application/xml", "application/xhtml+xml", "application/rss+xml", "application/atom+xml", "image/svg+xml"}
+
+// compressor is what gzip.Writer and brotli.Writer have in common
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Compression negotiates an encoding with each client and compresses the
+// responses that are worth it
+type Compression struct {
+	config  CompressionConfig
+	handler http.Handler
+	pools   map[string]*sync.Pool
+}
+
+func NewCompression(c CompressionConfig, handler http.Handler) *Compression {
+	if len(c.ContentTypes) == 0 {
+		c.ContentTypes = defaultCompressedTypes
+	}
+	if c.MinSize == 0 {
+		c.MinSize = 1 << 10
+	}
+	if c.GzipLevel < gzip.HuffmanOnly || c.GzipLevel > gzip.BestCompression {
+		log.WithFields(log.Fields{"gzip_level": c.GzipLevel}).Error("Invalid gzip level, using the default")
+		c.GzipLevel = 0
+	}
+	if c.GzipLevel == 0 {
+		c.GzipLevel = 6
+	}
+	if c.BrotliLevel < brotli.BestSpeed || c.BrotliLevel > brotli.BestCompression {
+		log.WithFields(log.Fields{"brotli_level": c.BrotliLevel}).Error("Invalid brotli level, using the default")
+		c.BrotliLevel = 0
+	}
+	if c.BrotliLevel == 0 {
+		c.BrotliLevel = 4
+	}
+	if len(c.Encodings) == 0 {
+		c.Encodings = []string{"br", "gzip"}
+	}
+	return &Compression{config: c, handler: handler, pools: map[string]*sync.Pool{
+		"gzip": {New: func() interface{} {
+			w, err := gzip.NewWriterLevel(io.Discard, c.GzipLevel)
+			if err != nil {
+				log.WithFields(log.Fields{"gzip_level": c.GzipLevel, "error": err}).Error("Couldn't create a gzip writer, using the default level")
+				return gzip.NewWriter(io.Discard)
+			}
+			return w
+		}},
+		"br": {New: func() interface{} {
+			return brotli.NewWriterLevel(io.Discard, c.BrotliLevel)
+		}},
+	}}
+}
+
+// NewCompressionHandler compresses responses if the service definition asks for it
+func NewCompressionHandler(s Service, handler http.Handler) http.Handler {
+	if !s.Compression.Enabled {
+		return handler
+	}
+	return NewCompression(s.Compression, handler)
+}
+
+func (c *Compression) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead || IsUpgradeRequest(r) || IsGRPCRequest(r) || r.Header.Get("Range") != "" {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressWriter{ResponseWriter: w, compression: c,
+		encoding: c.negotiate(r.Header.Values("Accept-Encoding"))}
+	defer cw.Close()
+	c.handler.ServeHTTP(cw, r)
+}
+
+// negotiate picks the first of our encodings the client accepts, or "" if we
+// should leave the response alone
+func (c *Compression) negotiate(acceptEncoding []string) string {
+	accepted := make(map[string]float64)
+	for _, value := range acceptEncoding {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			q := 1.0
+			if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+			accepted[strings.ToLower(strings.TrimSpace(name))] = q
+		}
+	}
+	for _, encoding := range c.config.Encodings {
+		if c.pools[encoding] == nil {
+			continue
+		}
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressible checks the response headers to see if we should touch it.
+// Streams are left alone so every event gets through as it is sent.
+func (c *Compression) compressible(status int, h http.Header) bool {
+	if status != http.StatusOK && status != http.StatusCreated && status != http.StatusAccepted &&
+		status != http.StatusNonAuthoritativeInfo {
+		return false
+	}
+	if encoding := h.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	if strings.Contains(h.Get("Cache-Control"), "no-transform") || h.Get("X-Accel-Buffering") == "no" {
+		return false
+	}
+	contentType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || contentType == "text/event-stream" {
+		return false
+	}
+	for _, allowed := range c.config.ContentTypes {
+		if allowed == contentType ||
+			strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter holds back the start of a response until it knows whether it
+// is big enough to compress, even when the handler flushes before then.
+// Server-Sent Events, which need every event sent straight away, are never
+// held back.
+type compressWriter struct {
+	http.ResponseWriter
+	compression *Compression
+	encoding    string
+	status      int
+	decided     bool
+	buffer      []byte
+	encoder     compressor
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+
+	h := w.Header()
+	if !w.compression.compressible(status, h) {
+		w.passThrough()
+		return
+	}
+	// Caches have to keep compressed and plain copies apart
+	if !headerHasToken(h, "Vary", "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if w.encoding == "" {
+		w.passThrough()
+		return
+	}
+	if length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		if length < int64(w.compression.config.MinSize) {
+			w.passThrough()
+		} else {
+			w.startCompressing()
+		}
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.decided {
+		if w.encoder != nil {
+			return w.encoder.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buffer = append(w.buffer, b...)
+	if int64(len(w.buffer)) >= int64(w.compression.config.MinSize) {
+		w.startCompressing()
+	}
+	return len(b), nil
+}
+
+func (w *compressWriter) passThrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+	w.writeBuffer(w.ResponseWriter)
+}
+
+func (w *compressWriter) startCompressing() {
+	w.decided = true
+	h := w.Header()
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	// The compressed body is a different representation
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.encoder = w.compression.pools[w.encoding].Get().(compressor)
+	w.encoder.Reset(w.ResponseWriter)
+	w.writeBuffer(w.encoder)
+}
+
+func (w *compressWriter) writeBuffer(dst io.Writer) {
+	if len(w.buffer) > 0 {
+		dst.Write(w.buffer)
+		w.buffer = nil
+	}
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		return
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close finishes the response once the handler is done with it
+func (w *compressWriter) Close() {
+	if w.status != 0 && !w.decided {
+		w.passThrough()
+	}
+	if w.encoder != nil {
+		w.encoder.Close()
+		w.compression.pools[w.encoding].Put(w.encoder)
+		w.encoder = nil
+	}
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var compressibleBody = strings.Repeat("conductor compresses this nicely. ", 100)
+
+func compressGet(c CompressionConfig, acceptEncoding string, upstream http.HandlerFunc) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	res := httptest.NewRecorder()
+	c.Enabled = true
+	NewCompressionHandler(Service{Compression: c}, upstream).ServeHTTP(res, r)
+	return res
+}
+
+func jsonResponse(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, body)
+	}
+}
+
+func TestCompressionNegotiate(t *testing.T) {
+	c := NewCompression(CompressionConfig{}, nil)
+	tests := map[string]string{
+		"gzip, deflate, br": "br",
+		"gzip":              "gzip",
+		"br;q=0, gzip":      "gzip",
+		"*":                 "br",
+		"*, br;q=0":         "gzip",
+		"identity":          "",
+		"":                  "",
+	}
+	for acceptEncoding, expected := range tests {
+		if result := c.negotiate([]string{acceptEncoding}); result != expected {
+			t.Errorf("Expected '%s' to pick '%s' but got '%s'", acceptEncoding, expected, result)
+		}
+	}
+}
+
+func TestCompressionGzip(t *testing.T) {
+	res := compressGet(CompressionConfig{}, "gzip", jsonResponse(compressibleBody))
+	if res.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzipped response but got '%s'", res.Header().Get("Content-Encoding"))
+	}
+	if res.Header().Get("Vary") != "Accept-Encoding" || res.Header().Get("ETag") != `W/"v1"` {
+		t.Errorf("Expected Vary and a weak ETag but got %v", res.Header())
+	}
+	reader, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(reader)
+	if string(body) != compressibleBody {
+		t.Error("Expected the body to survive compression")
+	}
+}
+
+func TestCompressionBrotli(t *testing.T) {
+	res := compressGet(CompressionConfig{}, "gzip, br", jsonResponse(compressibleBody))
+	if res.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("Expected a brotli response but got '%s'", res.Header().Get("Content-Encoding"))
+	}
+	if res.Body.Len() >= len(compressibleBody) {
+		t.Errorf("Expected the body to shrink from %d bytes but it is %d", len(compressibleBody), res.Body.Len())
+	}
+	body, _ := io.ReadAll(brotli.NewReader(res.Body))
+	if string(body) != compressibleBody {
+		t.Error("Expected the body to survive compression")
+	}
+}
+
+func TestCompressionSkips(t *testing.T) {
+	tests := map[string]struct {
+		config   CompressionConfig
+		upstream http.HandlerFunc
+	}{
+		"small": {CompressionConfig{}, jsonResponse("{}")},
+		"content type": {CompressionConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, compressibleBody)
+		}},
+		"already encoded": {CompressionConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "deflate")
+			io.WriteString(w, compressibleBody)
+		}},
+		"no-transform": {CompressionConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Cache-Control", "no-transform")
+			io.WriteString(w, compressibleBody)
+		}},
+		"server sent events": {CompressionConfig{ContentTypes: []string{"text/*"}}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, compressibleBody)
+		}},
+		"flushed server sent events": {CompressionConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: {}\n\n")
+			http.NewResponseController(w).Flush()
+			io.WriteString(w, compressibleBody)
+		}},
+	}
+	for name, test := range tests {
+		res := compressGet(test.config, "gzip, br", test.upstream)
+		if encoding := res.Header().Get("Content-Encoding"); encoding == "gzip" || encoding == "br" {
+			t.Errorf("%s: expected the response to be left alone but it was %s encoded", name, encoding)
+		}
+	}
+}
+
+func TestCompressionBuffersAcrossFlushes(t *testing.T) {
+	res := compressGet(CompressionConfig{}, "gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "[")
+		http.NewResponseController(w).Flush()
+		io.WriteString(w, compressibleBody+"]")
+	})
+	if res.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a flush before min_size not to stop compression but got '%s'", res.Header().Get("Content-Encoding"))
+	}
+	reader, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(reader)
+	if string(body) != "["+compressibleBody+"]" {
+		t.Error("Expected the body to survive compression")
+	}
+}
+
+func TestCompressionInvalidLevels(t *testing.T) {
+	for _, c := range []CompressionConfig{{GzipLevel: 12}, {GzipLevel: -3}, {BrotliLevel: 12}, {BrotliLevel: -1}} {
+		for _, encoding := range []string{"gzip", "br"} {
+			res := compressGet(c, encoding, jsonResponse(compressibleBody))
+			if res.Header().Get("Content-Encoding") != encoding {
+				t.Errorf("%+v: expected %s at the default level but got '%s'", c, encoding, res.Header().Get("Content-Encoding"))
+			}
+		}
+	}
+}
+
+func TestCompressionVaryWithoutAcceptEncoding(t *testing.T) {
+	res := compressGet(CompressionConfig{}, "", jsonResponse(compressibleBody))
+	if res.Header().Get("Content-Encoding") != "" || res.Body.String() != compressibleBody {
+		t.Error("Expected a plain response for a client that doesn't accept compression")
+	}
+	if res.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding but got '%s'", res.Header().Get("Vary"))
+	}
+}
+
+func TestCompressionSkipsUpgrades(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	var wrapped bool
+	NewCompression(CompressionConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, wrapped = w.(*compressWriter)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if wrapped {
+		t.Error("Expected upgrade requests to get the connection's own ResponseWriter")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConcurrencyConfig caps how many requests a service has in flight at once, eg
+// {"max_concurrent": 100, "max_queue": 20, "queue_timeout": "250ms"}
+type ConcurrencyConfig struct {
+	// The most requests proxied at once. Zero turns the limit off.
+	MaxConcurrent int `json:"max_concurrent"`
+	// How many requests can wait for a slot before we shed load
+	MaxQueue int `json:"max_queue"`
+	// How long a request can wait for a slot. Defaults to one second.
+	QueueTimeout Duration `json:"queue_timeout"`
+	// "aimd" or "gradient" to adjust the limit by watching latency, with
+	// MaxConcurrent as the ceiling. Empty keeps the limit fixed.
+	Adaptive string `json:"adaptive"`
+	// The adaptive limit never drops below this. Defaults to one.
+	MinConcurrent int `json:"min_concurrent"`
+	// For aimd, responses slower than this count as overload. Defaults to one second.
+	LatencyTarget Duration `json:"latency_target"`
+}
+
+// ConcurrencyLimiter hands out slots for in-flight requests with a small FIFO
+// queue for requests waiting on one.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	config   ConcurrencyConfig
+	limit    float64
+	inflight int
+	waiters  []chan bool
+
+	// gradient state
+	minLatency      time.Duration
+	minLatencyReset time.Time
+	now             func() time.Time
+}
+
+func NewConcurrencyLimiter(c ConcurrencyConfig) *ConcurrencyLimiter {
+	if c.QueueTimeout.Duration == 0 {
+		c.QueueTimeout.Duration = time.Second
+	}
+	if c.MinConcurrent < 1 {
+		c.MinConcurrent = 1
+	}
+	if c.LatencyTarget.Duration == 0 {
+		c.LatencyTarget.Duration = time.Second
+	}
+	return &ConcurrencyLimiter{config: c, limit: float64(c.MaxConcurrent), now: time.Now}
+}
+
+// Limit returns the current limit, which only moves in adaptive mode
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Acquire waits for a slot. It gives up straight away if the queue is full, and
+// after the queue timeout or when ctx is done otherwise.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) bool {
+	l.mu.Lock()
+	if l.inflight < int(l.limit) && len(l.waiters) == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		return true
+	}
+	if len(l.waiters) >= l.config.MaxQueue {
+		l.mu.Unlock()
+		return false
+	}
+	ready := make(chan bool)
+	l.waiters = append(l.waiters, ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.config.QueueTimeout.Duration)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiters {
+		if w == ready {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return false
+		}
+	}
+	// We were handed a slot while giving up, so give it back
+	l.inflight--
+	l.wakeWaiters()
+	return false
+}
+
+// Release gives a slot back. latency and overloaded feed the adaptive limit.
+func (l *ConcurrencyLimiter) Release(latency time.Duration, overloaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	switch l.config.Adaptive {
+	case "aimd":
+		l.aimd(latency, overloaded)
+	case "gradient":
+		l.gradient(latency, overloaded)
+	}
+	l.wakeWaiters()
+}
+
+func (l *ConcurrencyLimiter) wakeWaiters() {
+	for l.inflight < int(l.limit) && len(l.waiters) > 0 {
+		ready := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		l.inflight++
+		close(ready)
+	}
+}
+
+// aimd grows the limit by one for every limit's worth of good responses and
+// cuts it by 10% on a slow response or overload.
+func (l *ConcurrencyLimiter) aimd(latency time.Duration, overloaded bool) {
+	if overloaded || latency > l.config.LatencyTarget.Duration {
+		l.limit = l.limit * 0.9
+	} else {
+		l.limit += 1 / l.limit
+	}
+	l.clampLimit()
+}
+
+// gradient compares each response time to the best seen recently. The limit
+// shrinks in proportion to how much slower things are and grows by a small
+// queue allowance when they aren't, much like Netflix's gradient limiter.
+func (l *ConcurrencyLimiter) gradient(latency time.Duration, overloaded bool) {
+	now := l.now()
+	if l.minLatency == 0 || latency < l.minLatency || now.After(l.minLatencyReset) {
+		l.minLatency = latency
+		l.minLatencyReset = now.Add(time.Minute)
+	}
+	ratio := 0.5
+	if !overloaded && latency > 0 {
+		ratio = math.Max(0.5, math.Min(1, float64(l.minLatency)/float64(latency)))
+	}
+	target := l.limit*ratio + math.Sqrt(l.limit)
+	l.limit = l.limit*0.8 + target*0.2
+	l.clampLimit()
+}
+
+func (l *ConcurrencyLimiter) clampLimit() {
+	l.limit = math.Max(float64(l.config.MinConcurrent), math.Min(float64(l.config.MaxConcurrent), l.limit))
+}
+
+// NewConcurrencyLimitHandler sheds load with a 503 once a service has too many
+// requests in flight and waiting. Upgraded connections aren't counted, they
+// are long lived and have their own idle timeout.
+func NewConcurrencyLimitHandler(s Service, handler http.Handler) http.Handler {
+	if s.Concurrency.MaxConcurrent < 1 {
+		return handler
+	}
+	limiter := NewConcurrencyLimiter(s.Concurrency)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsUpgradeRequest(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !limiter.Acquire(r.Context()) {
+			serviceOverloaded(w, r, limiter.Limit())
+			return
+		}
+		start := time.Now()
+		sw := newStatusWriter(w)
+		defer func() {
+			status := sw.Status()
+			overloaded := status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout ||
+				status == http.StatusBadGateway
+			limiter.Release(time.Since(start), overloaded)
+		}()
+		handler.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyConfig{MaxConcurrent: 1, MaxQueue: 1,
+		QueueTimeout: Duration{time.Second}})
+
+	if !l.Acquire(context.Background()) {
+		t.Fatal("Expected the first request to get a slot")
+	}
+
+	queued := make(chan bool)
+	go func() { queued <- l.Acquire(context.Background()) }()
+	waitFor(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.waiters) == 1
+	})
+
+	if l.Acquire(context.Background()) {
+		t.Error("Expected a request to be shed with the queue full")
+	}
+
+	l.Release(time.Millisecond, false)
+	if !<-queued {
+		t.Error("Expected the queued request to get the released slot")
+	}
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyConfig{MaxConcurrent: 1, MaxQueue: 5,
+		QueueTimeout: Duration{20 * time.Millisecond}})
+	l.Acquire(context.Background())
+
+	start := time.Now()
+	if l.Acquire(context.Background()) {
+		t.Error("Expected the queued request to time out")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("Expected the request to wait for the queue timeout")
+	}
+	if len(l.waiters) != 0 {
+		t.Errorf("Expected the timed out request to leave the queue but %d are waiting", len(l.waiters))
+	}
+}
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyConfig{MaxConcurrent: 100, Adaptive: "aimd",
+		MinConcurrent: 5, LatencyTarget: Duration{100 * time.Millisecond}})
+
+	for i := 0; i < 10; i++ {
+		l.Acquire(context.Background())
+		l.Release(time.Second, false)
+	}
+	if l.Limit() != 34 {
+		t.Errorf("Expected ten slow responses to cut the limit to 34 but got %d", l.Limit())
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Acquire(context.Background())
+		l.Release(10*time.Millisecond, false)
+	}
+	if l.Limit() <= 34 {
+		t.Errorf("Expected fast responses to grow the limit but got %d", l.Limit())
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Acquire(context.Background())
+		l.Release(10*time.Millisecond, true)
+	}
+	if l.Limit() != 5 {
+		t.Errorf("Expected the limit to bottom out at 5 but got %d", l.Limit())
+	}
+}
+
+func TestConcurrencyLimiterGradient(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyConfig{MaxConcurrent: 100, Adaptive: "gradient"})
+
+	l.Acquire(context.Background())
+	l.Release(10*time.Millisecond, false)
+	if l.Limit() != 100 {
+		t.Errorf("Expected steady latency to keep the limit at the ceiling but got %d", l.Limit())
+	}
+
+	for i := 0; i < 20; i++ {
+		l.Acquire(context.Background())
+		l.Release(100*time.Millisecond, false)
+	}
+	if l.Limit() >= 50 {
+		t.Errorf("Expected 10x slower responses to cut the limit but got %d", l.Limit())
+	}
+}
+
+func TestConcurrencyLimitHandlerSheds(t *testing.T) {
+	release := make(chan bool)
+	started := make(chan bool)
+	s := Service{Name: "slow", MountPoint: "/slow", Concurrency: ConcurrencyConfig{MaxConcurrent: 2}}
+	handler := NewConcurrencyLimitHandler(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, httptest.NewRequest("GET", "/slow/", nil))
+			codes <- res.Code
+		}()
+	}
+
+	// Both slots are taken and there is no queue
+	<-started
+	<-started
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/slow/", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 but got %d", res.Code)
+	}
+	expected := `{"error":"service_overloaded","message":"Too many requests in progress for '/slow/'"}` + "\n"
+	if res.Body.String() != expected {
+		t.Errorf("Expected body '%s' but got '%s'", expected, res.Body.String())
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusNoContent {
+			t.Errorf("Expected requests holding slots to finish with 204 but got %d", code)
+		}
+	}
+}
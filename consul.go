@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Consul holds the consul configuration
@@ -13,11 +18,59 @@ type Consul struct {
 	KVPrefix string
 }
 
-// Service is our internal mapping for a service
+// Service is our internal mapping for a service. The KV value for a service is
+// either its mount point or a JSON definition using the json field names below.
 type Service struct {
-	Name       string
-	MountPoint string
-	Nodes      []Node
+	Name       string `json:"-"`
+	MountPoint string `json:"mount_point"`
+	// Either "http", the default, or "grpc"
+	Type    string        `json:"type"`
+	Nodes   []Node        `json:"-"`
+	Backend BackendConfig `json:"backend"`
+	// How long an upgraded connection, eg a WebSocket, can sit with no traffic
+	// in either direction. Defaults to --upgrade-idle-timeout.
+	UpgradeIdleTimeout Duration `json:"upgrade_idle_timeout"`
+	// Every limit has to allow a request for it to be proxied
+	RateLimits []RateLimitConfig `json:"rate_limits"`
+	// Cap on requests in flight, with load shedding past it
+	Concurrency ConcurrencyConfig `json:"concurrency"`
+	// Cache responses that allow it
+	Cache CacheConfig `json:"cache"`
+	// Share one upstream request between identical concurrent GETs
+	Coalesce CoalesceConfig `json:"coalesce"`
+	// Compress responses for clients that accept gzip or brotli
+	Compression CompressionConfig `json:"compression"`
+	// Send a share of the traffic to other versions of the service
+	Split SplitConfig `json:"split"`
+	// Copy a share of the requests to a shadow service
+	Mirror MirrorConfig `json:"mirror"`
+	// Delay or fail matching requests on purpose
+	Faults []FaultRule `json:"faults"`
+	// Require a valid JWT
+	JWT JWTConfig `json:"jwt"`
+	// Ask an authorization service about each request first
+	AuthRequest AuthRequestConfig `json:"auth_request"`
+	// Only let in some clients, or ask for a password
+	Access AccessConfig `json:"access"`
+	// Let browsers call the service from other origins
+	CORS CORSConfig `json:"cors"`
+
+	// Set on the services made for each version in a split, to MirrorVersion
+	// for the shadow service of a mirror and to AuthRequestVersion for an
+	// authorization service
+	Version string `json:"-"`
+	// Only nodes with Tag, if set, and none of ExcludeTags are used
+	Tag         string   `json:"-"`
+	ExcludeTags []string `json:"-"`
+}
+
+// Key is how the load balancer knows the service: the mount point, plus the
+// version for the versions in a split
+func (s Service) Key() string {
+	if s.Version != "" {
+		return fmt.Sprintf("%s@%s", s.MountPoint, s.Version)
+	}
+	return s.MountPoint
 }
 
 // ServiceList is just an array of services
@@ -28,6 +81,84 @@ type Node struct {
 	Name    string
 	Address string
 	Port    int
+	Tags    []string
+}
+
+// Duration lets service definitions give durations as strings like "30s" or
+// as a number of seconds.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		d.Duration = time.Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		d.Duration = parsed
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+// MarshalJSON writes durations the way they are read, eg "1m30s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// ByteSize lets service definitions give sizes as strings like "64MB" or as a
+// number of bytes.
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*b = ByteSize(v)
+	case string:
+		parsed, err := ParseByteSize(v)
+		if err != nil {
+			return err
+		}
+		*b = parsed
+	default:
+		return fmt.Errorf("invalid size %s", data)
+	}
+	return nil
+}
+
+// ParseByteSize reads sizes like "512", "16KB", "64MB" or "1.5GB". Units are
+// powers of 1024.
+func ParseByteSize(s string) (ByteSize, error) {
+	number := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := float64(1)
+	for _, unit := range []struct {
+		suffix string
+		bytes  float64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return ByteSize(n * multiplier), nil
 }
 
 // NewConsul returns a new Consul object given a URL, datacenter and KV prefix
@@ -54,20 +185,52 @@ func (c *Consul) CleanupServiceName(name string) string {
 
 // Takes a consul KVPair and returns a Service struct
 func (c *Consul) MapKVToService(kv *api.KVPair) *Service {
-	mount, err := base64.StdEncoding.DecodeString(string(kv.Value))
 	name := c.CleanupServiceName(kv.Key)
+	if isServiceDefinition(kv.Value) {
+		return ParseServiceDefinition(name, kv.Value)
+	}
+	mount, err := base64.StdEncoding.DecodeString(string(kv.Value))
 	if err != nil {
 		return &Service{
 			Name:       name,
 			MountPoint: fmt.Sprintf("/%s", name),
 		}
 	}
+	if isServiceDefinition(mount) {
+		return ParseServiceDefinition(name, mount)
+	}
 	return &Service{
 		Name:       name,
 		MountPoint: string(mount),
 	}
 }
 
+func isServiceDefinition(value []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(value), []byte("{"))
+}
+
+// ParseServiceDefinition reads a JSON service definition. If it can't be parsed
+// the service is mounted at /<name> with everything else left at the defaults.
+func ParseServiceDefinition(name string, definition []byte) *Service {
+	service := &Service{}
+	if err := json.Unmarshal(definition, service); err != nil {
+		log.WithFields(log.Fields{"service": name,
+			"error": err}).Error("Could not parse service definition, using defaults")
+		service = &Service{}
+	}
+	service.Name = name
+	if service.MountPoint == "" {
+		service.MountPoint = fmt.Sprintf("/%s", name)
+	}
+	service.Split.Versions = service.Split.validVersions(name)
+	service.Faults = validFaultRules(name, service.Faults)
+	service.ExcludeTags = service.Split.excludedTags(name)
+	if tag := service.Mirror.excludedTag(name); tag != "" {
+		service.ExcludeTags = append(service.ExcludeTags, tag)
+	}
+	return service
+}
+
 // GetListOfServices does the actual query to Consul for the service names
 // underneath the KVPrefix
 func (c *Consul) GetListOfServices() (*ServiceList, error) {
@@ -94,15 +257,31 @@ func (c *Consul) AddNodesToService(service *Service, serviceHealth []*api.Servic
 	if length < 1 {
 		return service
 	}
-	service.Nodes = make([]Node, length, length)
-	for i, s := range serviceHealth {
+	service.Nodes = make([]Node, 0, length)
+	for _, s := range serviceHealth {
 		n := *s.Node
 		sv := *s.Service
-		service.Nodes[i] = Node{Name: n.Node, Address: n.Address, Port: sv.Port}
+		node := Node{Name: n.Node, Address: n.Address, Port: sv.Port, Tags: sv.Tags}
+		if service.usesNode(node) {
+			service.Nodes = append(service.Nodes, node)
+		}
 	}
 	return service
 }
 
+// usesNode checks the node's tags against the ones the service picks nodes by
+func (s *Service) usesNode(node Node) bool {
+	if s.Tag != "" && !hasTag(node, s.Tag, "") {
+		return false
+	}
+	for _, tag := range s.ExcludeTags {
+		if hasTag(node, tag, "") {
+			return false
+		}
+	}
+	return true
+}
+
 // GetHealthyNodesForService Does the actual query to Consul and adds the Healthy
 // Nodes to the service
 func (c *Consul) GetHealthyNodesForService(service *Service) (*Service, error) {
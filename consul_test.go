@@ -109,3 +109,56 @@ func TestAddNodesToService(t *testing.T) {
 		}
 	}
 }
+
+func TestMapKVToServiceWithDefinition(t *testing.T) {
+	input := &api.KVPair{Key: "conductor-services/secure",
+		Value: []byte(`{"mount_point": "/secure/v1", "backend": {"tls": true, "server_name": "secure.internal"}}`)}
+
+	result := consul.MapKVToService(input)
+	if result.Name != "secure" || result.MountPoint != "/secure/v1" {
+		t.Errorf("Expected secure mounted at /secure/v1 but got %s mounted at %s", result.Name, result.MountPoint)
+	}
+	if !result.Backend.TLS || result.Backend.ServerName != "secure.internal" {
+		t.Errorf("Expected backend TLS to secure.internal but got %+v", result.Backend)
+	}
+}
+
+func TestMapKVToServiceWithInvalidDefinition(t *testing.T) {
+	input := &api.KVPair{Key: "conductor-services/solr", Value: []byte(`{"mount_point": `)}
+
+	result := consul.MapKVToService(input)
+	if result.Name != "solr" || result.MountPoint != "/solr" {
+		t.Errorf("Expected solr mounted at /solr but got %s mounted at %s", result.Name, result.MountPoint)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]ByteSize{"512": 512, "16KB": 16 << 10, "64 mb": 64 << 20, "1.5GB": 3 << 29}
+	for input, expected := range tests {
+		if result, err := ParseByteSize(input); err != nil || result != expected {
+			t.Errorf("Expected '%s' to be %d bytes but got %d (%v)", input, expected, result, err)
+		}
+	}
+	if _, err := ParseByteSize("lots"); err == nil {
+		t.Error("Expected an invalid size to fail")
+	}
+}
+
+func TestAddNodesToServiceFiltersByTag(t *testing.T) {
+	entries := []*api.ServiceEntry{
+		{Node: &api.Node{Node: "api1"}, Service: &api.AgentService{Port: 80}},
+		{Node: &api.Node{Node: "api2"}, Service: &api.AgentService{Port: 80, Tags: []string{"canary"}}},
+	}
+
+	stable := &Service{Name: "api", ExcludeTags: []string{"canary"}}
+	consul.AddNodesToService(stable, entries)
+	if len(stable.Nodes) != 1 || stable.Nodes[0].Name != "api1" {
+		t.Errorf("Expected the stable version to leave out the canary node but got %+v", stable.Nodes)
+	}
+
+	canary := &Service{Name: "api", Tag: "canary"}
+	consul.AddNodesToService(canary, entries)
+	if len(canary.Nodes) != 1 || canary.Nodes[0].Name != "api2" {
+		t.Errorf("Expected the canary to only use the tagged node but got %+v", canary.Nodes)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig lets browsers call a service from other origins, eg
+// {"allowed_origins": ["https://app.example.com", "https://*.example.com"], "allow_credentials": true}
+type CORSConfig struct {
+	// Exact origins, "*" for any origin, wildcards like "https://*.example.com",
+	// or regular expressions starting with "~" that match the whole origin.
+	// Origins are lowercased before they are matched.
+	AllowedOrigins []string `json:"allowed_origins"`
+	// Defaults to GET, HEAD and POST
+	AllowedMethods []string `json:"allowed_methods"`
+	// Request headers scripts may set. "*" allows any. Defaults to Accept,
+	// Accept-Language, Content-Language and Content-Type.
+	AllowedHeaders []string `json:"allowed_headers"`
+	// Response headers scripts may read, besides the simple ones
+	ExposedHeaders []string `json:"exposed_headers"`
+	// Let browsers send cookies and Authorization. Not allowed with "*".
+	AllowCredentials bool `json:"allow_credentials"`
+	// How long browsers may cache a preflight. Browsers pick their own when unset.
+	MaxAge Duration `json:"max_age"`
+}
+
+func (c CORSConfig) enabled() bool {
+	return len(c.AllowedOrigins) > 0
+}
+
+// corsPolicy is a CORSConfig ready to check requests with
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	patterns    []*regexp.Regexp
+	methods     map[string]bool
+	anyHeader   bool
+	headers     map[string]bool
+	allow       string
+	expose      string
+	credentials bool
+	maxAge      string
+}
+
+func newCORSPolicy(s Service) *corsPolicy {
+	c := s.CORS
+	p := &corsPolicy{origins: make(map[string]bool), methods: make(map[string]bool),
+		headers: make(map[string]bool), credentials: c.AllowCredentials}
+	for _, origin := range c.AllowedOrigins {
+		var expr string
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+			continue
+		case strings.HasPrefix(origin, "~"):
+			expr = "^(?:" + origin[1:] + ")$"
+		case strings.Contains(origin, "*"):
+			expr = "^" + strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[a-z0-9-]+(?:\.[a-z0-9-]+)*`) + "$"
+		default:
+			p.origins[strings.ToLower(origin)] = true
+			continue
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			log.WithFields(log.Fields{"mount_point": s.MountPoint, "origin": origin,
+				"error": err}).Error("Ignoring invalid CORS origin")
+			continue
+		}
+		p.patterns = append(p.patterns, pattern)
+	}
+	if p.anyOrigin && p.credentials {
+		// Any site could read responses with the user's cookies
+		log.WithFields(log.Fields{"mount_point": s.MountPoint}).Error("CORS credentials can't be allowed for any origin, ignoring allow_credentials")
+		p.credentials = false
+	}
+
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{"GET", "HEAD", "POST"}
+	}
+	var allow []string
+	for _, method := range methods {
+		method = strings.ToUpper(method)
+		p.methods[method] = true
+		allow = append(allow, method)
+	}
+	p.allow = strings.Join(allow, ", ")
+
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{"Accept", "Accept-Language", "Content-Language", "Content-Type"}
+	}
+	for _, header := range headers {
+		if header == "*" {
+			p.anyHeader = true
+		}
+		p.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	p.expose = strings.Join(c.ExposedHeaders, ", ")
+	if c.MaxAge.Duration > 0 {
+		p.maxAge = strconv.Itoa(int(c.MaxAge.Seconds()))
+	}
+	return p
+}
+
+// allowsMethod checks a preflight's Access-Control-Request-Method. Browsers
+// never need permission for the simple methods.
+func (p *corsPolicy) allowsMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "POST":
+		return true
+	}
+	return p.methods[method]
+}
+
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	if p.anyOrigin || p.origins[origin] {
+		return true
+	}
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders checks a preflight's Access-Control-Request-Headers
+func (p *corsPolicy) allowsHeaders(requested []string) bool {
+	if p.anyHeader {
+		return true
+	}
+	for _, value := range requested {
+		for _, header := range strings.Split(value, ",") {
+			if header = strings.TrimSpace(header); header != "" && !p.headers[http.CanonicalHeaderKey(header)] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// varies is whether responses depend on the Origin. Only an open policy sends
+// the same "*" to everyone.
+func (p *corsPolicy) varies() bool {
+	return !p.anyOrigin
+}
+
+// setHeaders replaces any CORS headers in h with the policy's for origin
+func (p *corsPolicy) setHeaders(h http.Header, origin string) {
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			delete(h, name)
+		}
+	}
+	if p.varies() && !headerHasToken(h, "Vary", "Origin") {
+		h.Add("Vary", "Origin")
+	}
+	if !p.allowsOrigin(origin) {
+		return
+	}
+	if p.varies() {
+		h.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if p.expose != "" {
+		h.Set("Access-Control-Expose-Headers", p.expose)
+	}
+}
+
+// NewCORSHandler answers preflight requests for the service itself and puts
+// the service's CORS headers on every other response, in place of any the
+// node sent
+func NewCORSHandler(s Service, handler http.Handler) http.Handler {
+	if !s.CORS.enabled() {
+		return handler
+	}
+	policy := newCORSPolicy(s)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		method := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || origin == "" || method == "" {
+			handler.ServeHTTP(&corsWriter{ResponseWriter: w, policy: policy, origin: origin}, r)
+			return
+		}
+
+		requested := r.Header.Values("Access-Control-Request-Headers")
+		if !policy.allowsOrigin(origin) || !policy.allowsMethod(method) || !policy.allowsHeaders(requested) {
+			w.Header().Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+			forbidden(w, r, "cors_preflight")
+			return
+		}
+		h := w.Header()
+		policy.setHeaders(h, origin)
+		h.Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", policy.allow)
+		if len(requested) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		}
+		if policy.maxAge != "" {
+			h.Set("Access-Control-Max-Age", policy.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// corsWriter sets the CORS headers just before the response goes out, so
+// they replace the node's
+type corsWriter struct {
+	http.ResponseWriter
+	policy      *corsPolicy
+	origin      string
+	wroteHeader bool
+}
+
+func (w *corsWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.policy.setHeaders(w.Header(), w.origin)
+		w.wroteHeader = status >= http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *corsWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *corsWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
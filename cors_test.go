@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSOrigins(t *testing.T) {
+	policy := newCORSPolicy(Service{CORS: CORSConfig{AllowedOrigins: []string{"https://app.example.com",
+		"https://*.example.org", `~https://review-[0-9]+\.example\.net`, "~(bad"}}})
+
+	tests := map[string]bool{
+		"https://app.example.com":          true,
+		"https://APP.example.com":          true,
+		"http://app.example.com":           false,
+		"https://app.example.com.evil.com": false,
+		"https://a.example.org":            true,
+		"https://a.b.example.org":          true,
+		"https://example.org":              false,
+		"https://evil.com/.example.org":    false,
+		"https://review-42.example.net":    true,
+		"https://review-x.example.net":     false,
+		"https://review-42.example.net.io": false,
+		"https://REVIEW-42.Example.net":    true,
+		"https://A.Example.org":            true,
+		"":                                 false,
+	}
+	for origin, allowed := range tests {
+		if policy.allowsOrigin(origin) != allowed {
+			t.Errorf("Expected '%s' allowed to be %v", origin, allowed)
+		}
+	}
+}
+
+func TestCORSAnyOriginWithoutCredentials(t *testing.T) {
+	s, backend := newTestCORSService(CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	handler := NewCORSHandler(s, backend)
+
+	r := httptest.NewRequest("GET", "/orders/1", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+	if res.Header().Get("Access-Control-Allow-Origin") != "*" || res.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("Expected any origin to be allowed without credentials but got %v", res.Header())
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	s, backend := newTestCORSService(CORSConfig{AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"get", "put", "delete"}, AllowedHeaders: []string{"Content-Type", "Authorization"},
+		AllowCredentials: true, MaxAge: Duration{10 * time.Minute}})
+	handler := NewCORSHandler(s, backend)
+
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("OPTIONS", "/orders/1", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			r.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, r)
+		return res
+	}
+
+	res := preflight("https://app.example.com", "PUT", "content-type,authorization")
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("Expected the preflight to be answered but got %d %s", res.Code, res.Body.String())
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "GET, PUT, DELETE",
+		"Access-Control-Allow-Headers":     "content-type,authorization",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+		"Vary":                             "Origin",
+	}
+	for name, value := range expected {
+		if res.Header().Get(name) != value {
+			t.Errorf("Expected %s to be '%s' but got '%s'", name, value, res.Header().Get(name))
+		}
+	}
+
+	for name, res := range map[string]*httptest.ResponseRecorder{
+		"origin":  preflight("https://evil.com", "PUT", ""),
+		"method":  preflight("https://app.example.com", "PATCH", ""),
+		"headers": preflight("https://app.example.com", "PUT", "X-Debug"),
+	} {
+		if res.Code != http.StatusForbidden || res.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s: expected the preflight to be refused but got %d %v", name, res.Code, res.Header())
+		}
+	}
+	if backend.requests != 0 {
+		t.Errorf("Expected preflights to stay away from the node but it got %d", backend.requests)
+	}
+}
+
+func TestCORSResponses(t *testing.T) {
+	s, backend := newTestCORSService(CORSConfig{AllowedOrigins: []string{"*"}, ExposedHeaders: []string{"X-Total"}})
+	handler := NewCORSHandler(s, backend)
+
+	r := httptest.NewRequest("GET", "/orders/1", nil)
+	r.Header.Set("Origin", "https://anywhere.example.com")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+	if res.Header().Get("Access-Control-Allow-Origin") != "*" || res.Header().Get("Access-Control-Expose-Headers") != "X-Total" {
+		t.Errorf("Expected the policy's headers but got %v", res.Header())
+	}
+	if res.Header().Get("Access-Control-Allow-Methods") != "" || res.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected the node's CORS headers to be replaced but got %v", res.Header())
+	}
+
+	// OPTIONS without a preflight's headers is an ordinary request
+	r = httptest.NewRequest("OPTIONS", "/orders/1", nil)
+	r.Header.Set("Origin", "https://anywhere.example.com")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if backend.requests != 2 {
+		t.Errorf("Expected both requests to reach the node but it got %d", backend.requests)
+	}
+}
+
+func TestCORSBeforeAuthentication(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	s := serviceForTestServer("orders", "/orders", backend)
+	s.JWT = JWTConfig{JWKSFile: "/nonexistent/jwks.json"}
+	s.CORS = CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowedHeaders: []string{"Authorization"}}
+	proxy, stop := newTestProxy(t, s)
+	defer stop()
+	handler := NewServiceHandler(s, proxy, nil, NewUpgradeTracker(), nil, NewFaults(), NewAccess())
+
+	r := httptest.NewRequest("OPTIONS", "/orders/1", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	r.Header.Set("Access-Control-Request-Headers", "authorization")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+	if res.Code != http.StatusNoContent {
+		t.Errorf("Expected the preflight to be answered without a token but got %d", res.Code)
+	}
+
+	// Scripts can read conductor's own errors
+	r = httptest.NewRequest("GET", "/orders/1", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+	if res.Code != http.StatusUnauthorized || res.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("Expected a 401 with CORS headers but got %d %v", res.Code, res.Header())
+	}
+}
+
+type testCORSBackend struct {
+	requests int
+}
+
+func (b *testCORSBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.requests++
+	w.Header().Set("Access-Control-Allow-Origin", "https://stale.example.com")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Write([]byte("order 1"))
+}
+
+func newTestCORSService(c CORSConfig) (Service, *testCORSBackend) {
+	return Service{Name: "orders", MountPoint: "/orders", CORS: c}, &testCORSBackend{}
+}
@@ -1,30 +1,191 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 	"html"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func noMatchingMountPointHandler(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":     requestIDFrom(r),
 		"remote_address": r.RemoteAddr,
+		"client_ip":      clientIP(r),
 		"error":          "no_matching_mount_point",
 	}).Warn("No mount point matches")
-	http.Error(w,
-		fmt.Sprintf(`{"error":"no_matching_mount_point","message":"I have no backend servers that handle '%s'"}`,
-			html.EscapeString(r.URL.Path)), http.StatusBadGateway)
+	writeError(w, r, http.StatusBadGateway, "no_matching_mount_point",
+		fmt.Sprintf("I have no backend servers that handle '%s'", html.EscapeString(r.URL.Path)))
 }
 
 func noHealthyBackends(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":     requestIDFrom(r),
 		"remote_address": r.RemoteAddr,
+		"client_ip":      clientIP(r),
 		"error":          "no_health_backends",
 	}).Warn("No healthy backends")
-	http.Error(w,
-		fmt.Sprintf(`{"error":"no_healthy_backends","message":"There are no healthy backends that handle '%s'"}`,
-			html.EscapeString(r.URL.Path)), http.StatusServiceUnavailable)
+	writeError(w, r, http.StatusServiceUnavailable, "no_healthy_backends",
+		fmt.Sprintf("There are no healthy backends that handle '%s'", html.EscapeString(r.URL.Path)))
+}
+
+func backendTimeout(w http.ResponseWriter, r *http.Request, err error) {
+	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":     requestIDFrom(r),
+		"remote_address": r.RemoteAddr,
+		"client_ip":      clientIP(r),
+		"forward_to":     r.URL.Host,
+		"error":          err,
+	}).Warn("Backend timed out")
+	writeError(w, r, http.StatusGatewayTimeout, "backend_timeout",
+		fmt.Sprintf("The backend handling '%s' took too long to respond", html.EscapeString(r.URL.Path)))
+}
+
+func backendError(w http.ResponseWriter, r *http.Request, err error) {
+	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":     requestIDFrom(r),
+		"remote_address": r.RemoteAddr,
+		"client_ip":      clientIP(r),
+		"forward_to":     r.URL.Host,
+		"error":          err,
+	}).Warn("Backend request failed")
+	writeError(w, r, http.StatusBadGateway, "backend_error",
+		fmt.Sprintf("The backend handling '%s' could not be reached", html.EscapeString(r.URL.Path)))
+}
+
+func rateLimited(w http.ResponseWriter, r *http.Request, c RateLimitConfig, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":     requestIDFrom(r),
+		"remote_address": r.RemoteAddr,
+		"client_ip":      clientIP(r),
+		"rate_limit_key": c.Key,
+		"retry_after":    seconds,
+		"error":          "rate_limited",
+	}).Warn("Rate limit exceeded")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, r, http.StatusTooManyRequests, "rate_limited",
+		fmt.Sprintf("Too many requests for '%s', retry after %d seconds", html.EscapeString(r.URL.Path), seconds))
+}
+
+func serviceOverloaded(w http.ResponseWriter, r *http.Request, limit int) {
+	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":        requestIDFrom(r),
+		"remote_address":    r.RemoteAddr,
+		"client_ip":         clientIP(r),
+		"concurrency_limit": limit,
+		"error":             "service_overloaded",
+	}).Warn("Shedding load")
+	writeError(w, r, http.StatusServiceUnavailable, "service_overloaded",
+		fmt.Sprintf("Too many requests in progress for '%s'", html.EscapeString(r.URL.Path)))
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, reason string) {
+	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":     requestIDFrom(r),
+		"remote_address": r.RemoteAddr,
+		"client_ip":      clientIP(r),
+		"reason":         reason,
+		"error":          "unauthorized",
+	}).Info("Request not authorized")
+	writeError(w, r, http.StatusUnauthorized, "unauthorized",
+		fmt.Sprintf("A valid token is required for '%s'", html.EscapeString(r.URL.Path)))
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request, reason string) {
+	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":     requestIDFrom(r),
+		"remote_address": r.RemoteAddr,
+		"client_ip":      clientIP(r),
+		"reason":         reason,
+		"error":          "forbidden",
+	}).Info("Client not allowed")
+	writeError(w, r, http.StatusForbidden, "forbidden",
+		fmt.Sprintf("You are not allowed to access '%s'", html.EscapeString(r.URL.Path)))
+}
+
+func passwordRequired(w http.ResponseWriter, r *http.Request, user string) {
+	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":     requestIDFrom(r),
+		"remote_address": r.RemoteAddr,
+		"client_ip":      clientIP(r),
+		"user":           user,
+		"error":          "unauthorized",
+	}).Info("Request not authorized")
+	writeError(w, r, http.StatusUnauthorized, "unauthorized",
+		fmt.Sprintf("A valid username and password are required for '%s'", html.EscapeString(r.URL.Path)))
+}
+
+// injectedFault sends the error conductor would send with this status, so
+// clients can't tell a fault rule from the real thing
+func injectedFault(w http.ResponseWriter, r *http.Request, status int) {
+	log.WithFields(log.Fields{"url": r.URL.Path,
+		"request_id":     requestIDFrom(r),
+		"remote_address": r.RemoteAddr,
+		"client_ip":      clientIP(r),
+		"status":         status,
+		"error":          "fault_injected",
+	}).Info("Injecting fault")
+	path := html.EscapeString(r.URL.Path)
+	switch status {
+	case http.StatusBadGateway:
+		writeError(w, r, status, "backend_error",
+			fmt.Sprintf("The backend handling '%s' could not be reached", path))
+	case http.StatusServiceUnavailable:
+		writeError(w, r, status, "no_healthy_backends",
+			fmt.Sprintf("There are no healthy backends that handle '%s'", path))
+	case http.StatusGatewayTimeout:
+		writeError(w, r, status, "backend_timeout",
+			fmt.Sprintf("The backend handling '%s' took too long to respond", path))
+	default:
+		writeError(w, r, status, "fault_injected", fmt.Sprintf("Fault injected for '%s'", path))
+	}
+}
+
+// proxyErrorHandler is the reverse proxy ErrorHandler. It maps errors talking
+// to a backend onto the matching error response.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var netErr net.Error
+	switch {
+	case isNoHealthyNodesError(err):
+		noHealthyBackends(w, r)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		backendTimeout(w, r, err)
+	case errors.Is(err, context.Canceled):
+		// The client went away so nobody will see this. Like nginx we still
+		// record it as 499 Client Closed Request.
+		w.WriteHeader(499)
+	default:
+		backendError(w, r, err)
+	}
+}
+
+func isNoHealthyNodesError(err error) bool {
+	var noHealthyNodes *NoHealthyNodesError
+	return errors.As(err, &noHealthyNodes)
+}
+
+// writeError sends one of conductor's own errors as a small JSON body. gRPC
+// clients get a trailers-only response with the closest grpc-status instead.
+func writeError(w http.ResponseWriter, r *http.Request, status int, name, message string) {
+	if IsGRPCRequest(r) {
+		writeGRPCError(w, GRPCStatusFor(status, name), message)
+		return
+	}
+	if id := requestIDFrom(r); id != "" {
+		http.Error(w, fmt.Sprintf(`{"error":"%s","message":"%s","request_id":"%s"}`, name, message, id), status)
+		return
+	}
+	http.Error(w, fmt.Sprintf(`{"error":"%s","message":"%s"}`, name, message), status)
 }
 
 // Simply sends a 204, No content
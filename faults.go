@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultRule delays or fails matching requests on purpose, to see how clients
+// cope, eg
+// {"path": "/api/orders", "headers": {"X-Game-Day": "true"}, "abort": 503, "abort_percent": 20}
+type FaultRule struct {
+	// Requests whose path starts with this. Defaults to every request.
+	Path string `json:"path"`
+	// Only these methods. Defaults to all of them.
+	Methods []string `json:"methods"`
+	// Only requests with these headers. An empty value matches any value, so
+	// test traffic can be picked out without touching anyone else.
+	Headers map[string]string `json:"headers"`
+	// Wait this long before handling the request
+	Delay        Duration `json:"delay"`
+	DelayPercent float64  `json:"delay_percent"`
+	// Answer with this status, eg 502 or 503, instead of proxying. The body is
+	// the error conductor itself would send with that status.
+	Abort        int     `json:"abort"`
+	AbortPercent float64 `json:"abort_percent"`
+	// Keeps the rule around without applying it
+	Disabled bool `json:"disabled"`
+}
+
+func (f FaultRule) matches(r *http.Request) bool {
+	if f.Disabled || !strings.HasPrefix(r.URL.Path, f.Path) {
+		return false
+	}
+	if len(f.Methods) > 0 {
+		matched := false
+		for _, method := range f.Methods {
+			matched = matched || strings.EqualFold(method, r.Method)
+		}
+		if !matched {
+			return false
+		}
+	}
+	for name, value := range f.Headers {
+		got, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || value != "" && (len(got) == 0 || got[0] != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks the rule can be applied. An abort outside 4xx and 5xx would
+// make net/http panic on every matching request.
+func (f FaultRule) validate() error {
+	if f.Abort != 0 && (f.Abort < 400 || f.Abort > 599) {
+		return fmt.Errorf("abort has to be a 4xx or 5xx status, not %d", f.Abort)
+	}
+	if f.AbortPercent < 0 || f.AbortPercent > 100 {
+		return fmt.Errorf("abort_percent has to be between 0 and 100, not %g", f.AbortPercent)
+	}
+	if f.DelayPercent < 0 || f.DelayPercent > 100 {
+		return fmt.Errorf("delay_percent has to be between 0 and 100, not %g", f.DelayPercent)
+	}
+	if f.Delay.Duration < 0 {
+		return fmt.Errorf("delay can't be negative, not %s", f.Delay.Duration)
+	}
+	return nil
+}
+
+// validFaultRules drops the rules from a service definition that can't be
+// applied
+func validFaultRules(service string, rules []FaultRule) []FaultRule {
+	var valid []FaultRule
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			log.WithFields(log.Fields{"service": service, "rule": i,
+				"error": err}).Error("Ignoring invalid fault injection rule")
+			continue
+		}
+		valid = append(valid, rule)
+	}
+	return valid
+}
+
+// Percentages default to every matching request
+func faultPercent(percent float64) float64 {
+	if percent == 0 {
+		return 100
+	}
+	return percent
+}
+
+// Faults holds the fault rules for every service, by name since that is the KV
+// key. Rules come from service definitions and from the admin API, and the
+// admin API's are checked first.
+type Faults struct {
+	mu       sync.RWMutex
+	config   map[string][]FaultRule
+	admin    map[string][]FaultRule
+	services map[string]bool
+	random   func() float64
+	sleep    func(r *http.Request, d time.Duration) bool
+}
+
+func NewFaults() *Faults {
+	return &Faults{
+		config:   make(map[string][]FaultRule),
+		admin:    make(map[string][]FaultRule),
+		services: make(map[string]bool),
+		random:   rand.Float64,
+		sleep:    sleepUnlessCanceled,
+	}
+}
+
+// sleepUnlessCanceled waits for d, or until the client goes away
+func sleepUnlessCanceled(r *http.Request, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// Update takes the rules from a changed service definition
+func (f *Faults) Update(s Service) {
+	rules := validFaultRules(s.Name, s.Faults)
+	f.mu.Lock()
+	f.config[s.Name] = rules
+	f.mu.Unlock()
+	log.WithFields(log.Fields{"service": s.Name,
+		"rules": len(rules)}).Info("Updated fault injection rules")
+}
+
+// Set replaces the admin API's rules for a service. It returns false for
+// services we don't serve, and an error for rules that can't be applied.
+func (f *Faults) Set(service string, rules []FaultRule) (bool, error) {
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return true, fmt.Errorf("rule %d: %s", i, err)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.services[service] {
+		return false, nil
+	}
+	if len(rules) == 0 {
+		delete(f.admin, service)
+	} else {
+		f.admin[service] = rules
+	}
+	log.WithFields(log.Fields{"service": service,
+		"rules": len(rules)}).Warn("Fault injection rules set through the admin API")
+	return true, nil
+}
+
+// Rule returns the first rule that matches the request, if any
+func (f *Faults) Rule(service string, r *http.Request) (FaultRule, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, rules := range [][]FaultRule{f.admin[service], f.config[service]} {
+		for _, rule := range rules {
+			if rule.matches(r) {
+				return rule, true
+			}
+		}
+	}
+	return FaultRule{}, false
+}
+
+// Wrap applies the service's rules to requests before they reach handler
+func (f *Faults) Wrap(s Service, handler http.Handler) http.Handler {
+	rules := validFaultRules(s.Name, s.Faults)
+	f.mu.Lock()
+	f.services[s.Name] = true
+	f.config[s.Name] = rules
+	f.mu.Unlock()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := f.Rule(s.Name, r)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if rule.Delay.Duration > 0 && f.random()*100 < faultPercent(rule.DelayPercent) {
+			log.WithFields(log.Fields{"url": r.URL.Path, "mount_point": s.MountPoint,
+				"delay": rule.Delay.Duration}).Debug("Injecting delay")
+			if !f.sleep(r, rule.Delay.Duration) {
+				w.WriteHeader(499)
+				return
+			}
+		}
+		if rule.Abort != 0 && f.random()*100 < faultPercent(rule.AbortPercent) {
+			injectedFault(w, r, rule.Abort)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// faultRules is how the admin API shows a service's rules
+type faultRules struct {
+	Config []FaultRule `json:"config"`
+	Admin  []FaultRule `json:"admin"`
+}
+
+// NewFaultAdminHandler serves the fault rules under /_admin/faults:
+//
+//	GET    /_admin/faults           every service's rules
+//	GET    /_admin/faults/<service> just that service's
+//	PUT    /_admin/faults/<service> replaces the admin rules with a JSON list
+//	DELETE /_admin/faults/<service> removes the admin rules
+func NewFaultAdminHandler(f *Faults) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_admin/faults"), "/")
+		switch {
+		case r.Method == http.MethodGet:
+			f.mu.RLock()
+			all := make(map[string]faultRules, len(f.services))
+			for name := range f.services {
+				if service == "" || service == name {
+					all[name] = faultRules{Config: f.config[name], Admin: f.admin[name]}
+				}
+			}
+			f.mu.RUnlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(all)
+		case r.Method == http.MethodPut || r.Method == http.MethodDelete:
+			var rules []FaultRule
+			if r.Method == http.MethodPut {
+				if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+					writeError(w, r, http.StatusBadRequest, "invalid_fault_rules", "Expected a JSON list of fault rules")
+					return
+				}
+			}
+			known, err := f.Set(service, rules)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid_fault_rules", html.EscapeString(err.Error()))
+				return
+			}
+			if !known {
+				writeError(w, r, http.StatusNotFound, "unknown_service",
+					fmt.Sprintf("There is no service named '%s'", html.EscapeString(service)))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET, PUT or DELETE")
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFaults(s Service) (*Faults, http.Handler) {
+	faults := NewFaults()
+	handler := faults.Wrap(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied"))
+	}))
+	return faults, handler
+}
+
+func TestFaultRuleMatches(t *testing.T) {
+	rule := FaultRule{Path: "/api/orders", Methods: []string{"POST"}, Headers: map[string]string{"X-Game-Day": "true"}}
+	tests := []struct {
+		method, path, header string
+		expected             bool
+	}{
+		{"POST", "/api/orders/1", "true", true},
+		{"post", "/api/orders", "true", true},
+		{"GET", "/api/orders", "true", false},
+		{"POST", "/api/users", "true", false},
+		{"POST", "/api/orders", "", false},
+		{"POST", "/api/orders", "false", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.header != "" {
+			r.Header.Set("X-Game-Day", test.header)
+		}
+		if matched := rule.matches(r); matched != test.expected {
+			t.Errorf("Expected %s %s with '%s' to match: %v", test.method, test.path, test.header, test.expected)
+		}
+	}
+
+	rule = FaultRule{Headers: map[string]string{"X-Game-Day": ""}}
+	r := httptest.NewRequest("GET", "/api", nil)
+	r.Header.Set("X-Game-Day", "anything")
+	if !rule.matches(r) {
+		t.Error("Expected an empty header value to match any value")
+	}
+}
+
+func TestFaultsAbort(t *testing.T) {
+	_, handler := newTestFaults(Service{Name: "api", MountPoint: "/api", Faults: []FaultRule{
+		{Headers: map[string]string{"X-Game-Day": "true"}, Abort: http.StatusServiceUnavailable},
+	}})
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Body.String() != "proxied" {
+		t.Errorf("Expected normal traffic to be left alone but got %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	r.Header.Set("X-Game-Day", "true")
+	handler.ServeHTTP(res, r)
+	if res.Code != http.StatusServiceUnavailable || !strings.Contains(res.Body.String(), `"error":"no_healthy_backends"`) {
+		t.Errorf("Expected conductor's own 503 but got %d %s", res.Code, res.Body.String())
+	}
+}
+
+func TestFaultsPercent(t *testing.T) {
+	faults, handler := newTestFaults(Service{Name: "api", MountPoint: "/api", Faults: []FaultRule{
+		{Abort: http.StatusBadGateway, AbortPercent: 10},
+	}})
+	faults.random = func() float64 { return 0.5 }
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected the request to miss the 10%% but got %d", res.Code)
+	}
+
+	faults.random = func() float64 { return 0.05 }
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Code != http.StatusBadGateway {
+		t.Errorf("Expected the request to be aborted but got %d", res.Code)
+	}
+}
+
+func TestFaultsDelay(t *testing.T) {
+	faults, handler := newTestFaults(Service{Name: "api", MountPoint: "/api", Faults: []FaultRule{
+		{Delay: Duration{2 * time.Second}},
+	}})
+	var slept time.Duration
+	faults.sleep = func(r *http.Request, d time.Duration) bool {
+		slept = d
+		return true
+	}
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if slept != 2*time.Second || res.Body.String() != "proxied" {
+		t.Errorf("Expected a 2s delay before proxying but got %s", slept)
+	}
+}
+
+func TestFaultsUpdate(t *testing.T) {
+	s := Service{Name: "api", MountPoint: "/api"}
+	faults, handler := newTestFaults(s)
+	s.Faults = []FaultRule{{Abort: http.StatusGatewayTimeout}}
+	faults.Update(s)
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the new rule to apply but got %d", res.Code)
+	}
+}
+
+func TestFaultsUpdateFollowsServiceName(t *testing.T) {
+	faults, handler := newTestFaults(Service{Name: "api", MountPoint: "/api"})
+	// The definition moves the service, which takes effect on restart, but its
+	// rules apply straight away
+	faults.Update(Service{Name: "api", MountPoint: "/v2/api", Faults: []FaultRule{{Abort: http.StatusGatewayTimeout}}})
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the rules to follow the service to its new mount point but got %d", res.Code)
+	}
+}
+
+func TestFaultRuleValidate(t *testing.T) {
+	valid := []FaultRule{{}, {Abort: 400}, {Abort: 599, AbortPercent: 100}, {Delay: Duration{time.Second}, DelayPercent: 0.5}}
+	for _, rule := range valid {
+		if err := rule.validate(); err != nil {
+			t.Errorf("Expected %+v to be valid but got %s", rule, err)
+		}
+	}
+	invalid := []FaultRule{{Abort: 42}, {Abort: 200}, {Abort: 1000}, {Abort: 502, AbortPercent: -1},
+		{Abort: 502, AbortPercent: 101}, {DelayPercent: 150}, {Delay: Duration{-time.Second}}}
+	for _, rule := range invalid {
+		if err := rule.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", rule)
+		}
+	}
+}
+
+func TestFaultsIgnoreInvalidRules(t *testing.T) {
+	s := Service{Name: "api", MountPoint: "/api"}
+	faults, handler := newTestFaults(s)
+	s.Faults = []FaultRule{{Abort: 42}, {Abort: http.StatusGatewayTimeout, Path: "/api/orders"}}
+	faults.Update(s)
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected the invalid rule to be ignored but got %d", res.Code)
+	}
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/orders", nil))
+	if res.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the valid rule to still apply but got %d", res.Code)
+	}
+}
+
+func TestFaultAdminHandler(t *testing.T) {
+	faults, handler := newTestFaults(Service{Name: "api", MountPoint: "/api"})
+	admin := NewFaultAdminHandler(faults)
+
+	res := httptest.NewRecorder()
+	admin.ServeHTTP(res, httptest.NewRequest("PUT", "/_admin/faults/api",
+		strings.NewReader(`[{"abort": 502, "delay": "2s", "delay_percent": 0.001}]`)))
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("Expected the rules to be set but got %d %s", res.Code, res.Body.String())
+	}
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Code != http.StatusBadGateway {
+		t.Errorf("Expected the admin rule to apply but got %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	admin.ServeHTTP(res, httptest.NewRequest("GET", "/_admin/faults", nil))
+	var all map[string]faultRules
+	if err := json.Unmarshal(res.Body.Bytes(), &all); err != nil {
+		t.Fatal(err)
+	}
+	if rules := all["api"].Admin; len(rules) != 1 || rules[0].Delay.Duration != 2*time.Second {
+		t.Errorf("Expected to read back the admin rule but got %s", res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	admin.ServeHTTP(res, httptest.NewRequest("DELETE", "/_admin/faults/api", nil))
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected the rule to be removed but got %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	admin.ServeHTTP(res, httptest.NewRequest("PUT", "/_admin/faults/api", strings.NewReader(`[{"abort": 1000}]`)))
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), `"error":"invalid_fault_rules"`) {
+		t.Errorf("Expected an invalid abort to be a 400 but got %d %s", res.Code, res.Body.String())
+	}
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected the invalid rule not to be set but got %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	admin.ServeHTTP(res, httptest.NewRequest("PUT", "/_admin/faults/nope", strings.NewReader(`[]`)))
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown service to be a 404 but got %d", res.Code)
+	}
+}
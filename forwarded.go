@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Networks is a list of addresses and CIDRs, eg the proxies we trust
+type Networks []*net.IPNet
+
+// ParseNetworks parses comma separated CIDRs or addresses
+func ParseNetworks(list string) (Networks, error) {
+	var networks Networks
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR '%s'", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Contains reports whether the address is in one of the networks
+func (n Networks) Contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forwarding works out who the client really is when conductor sits behind
+// other proxies, and tells nodes about it with X-Forwarded-* headers, the
+// RFC 7239 Forwarded header or both. Forwarding headers are only believed when
+// they come from a trusted proxy. Anyone else's are replaced.
+type Forwarding struct {
+	trusted    Networks
+	xForwarded bool
+	forwarded  bool
+}
+
+// NewForwarding trusts the comma separated CIDRs or addresses in trusted and
+// sends the headers named in headers: "x-forwarded", "forwarded", both or
+// "none"
+func NewForwarding(trusted, headers string) (*Forwarding, error) {
+	networks, err := ParseNetworks(trusted)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %s", err)
+	}
+	f := &Forwarding{trusted: networks}
+	for _, header := range strings.Split(headers, ",") {
+		switch strings.TrimSpace(strings.ToLower(header)) {
+		case "x-forwarded":
+			f.xForwarded = true
+		case "forwarded":
+			f.forwarded = true
+		case "none", "":
+		default:
+			return nil, fmt.Errorf("unknown forwarded header '%s'", header)
+		}
+	}
+	return f, nil
+}
+
+func (f *Forwarding) trusts(address string) bool {
+	return f.trusted.Contains(address)
+}
+
+// forwardedInfo is what Forwarding worked out about a request
+type forwardedInfo struct {
+	// The address the request came from, which may be a proxy
+	Peer string
+	// The first address that isn't a trusted proxy
+	ClientIP string
+	Proto    string
+	Host     string
+	// What the peer sent, believed only when it is a trusted proxy
+	trusted         bool
+	chain           []string
+	prefix          string
+	forwardedHeader string
+
+	sendXForwarded bool
+	sendForwarded  bool
+}
+
+type forwardedKey struct{}
+
+func forwardedInfoFrom(r *http.Request) *forwardedInfo {
+	info, _ := r.Context().Value(forwardedKey{}).(*forwardedInfo)
+	return info
+}
+
+// clientIP returns the address of the client, looking past trusted proxies
+func clientIP(r *http.Request) string {
+	if info := forwardedInfoFrom(r); info != nil {
+		return info.ClientIP
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the address the request came from without the port
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (f *Forwarding) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := f.info(r)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardedKey{}, info)))
+	})
+}
+
+func (f *Forwarding) info(r *http.Request) *forwardedInfo {
+	peer := peerIP(r)
+	info := &forwardedInfo{Peer: peer, ClientIP: peer, Proto: "http", Host: r.Host,
+		sendXForwarded: f.xForwarded, sendForwarded: f.forwarded}
+	if r.TLS != nil {
+		info.Proto = "https"
+	}
+	if !f.trusts(peer) {
+		return info
+	}
+
+	info.trusted = true
+	info.forwardedHeader = strings.Join(r.Header.Values("Forwarded"), ", ")
+	elements := parseForwarded(info.forwardedHeader)
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, value := range xff {
+			for _, address := range strings.Split(value, ",") {
+				info.chain = append(info.chain, strings.TrimSpace(address))
+			}
+		}
+	} else {
+		for _, element := range elements {
+			info.chain = append(info.chain, unquoteForwardedFor(element["for"]))
+		}
+	}
+	// The client is the last address a proxy we trust vouches for
+	for i := len(info.chain) - 1; i >= 0 && f.trusts(info.ClientIP); i-- {
+		info.ClientIP = info.chain[i]
+	}
+
+	if proto := firstValue(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+		info.Proto = proto
+	} else if len(elements) > 0 && elements[0]["proto"] != "" {
+		info.Proto = elements[0]["proto"]
+	}
+	if host := firstValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+		info.Host = host
+	} else if len(elements) > 0 && elements[0]["host"] != "" {
+		info.Host = elements[0]["host"]
+	}
+	info.prefix = strings.TrimSuffix(r.Header.Get("X-Forwarded-Prefix"), "/")
+	return info
+}
+
+// setForwardedHeaders replaces the forwarding headers on a request to a node.
+// prefix is the mount point that was stripped from the path, if any.
+func setForwardedHeaders(req *http.Request, prefix string) {
+	info := forwardedInfoFrom(req)
+	if info == nil {
+		info = (&Forwarding{xForwarded: true}).info(req)
+	}
+	h := req.Header
+
+	switch {
+	case info.sendXForwarded:
+		if len(info.chain) > 0 {
+			// The reverse proxy adds the peer to the end
+			h.Set("X-Forwarded-For", strings.Join(info.chain, ", "))
+		} else {
+			h.Del("X-Forwarded-For")
+		}
+		h.Set("X-Forwarded-Proto", info.Proto)
+		h.Set("X-Forwarded-Host", info.Host)
+		if prefix = info.prefix + prefix; prefix != "" {
+			h.Set("X-Forwarded-Prefix", prefix)
+		} else {
+			h.Del("X-Forwarded-Prefix")
+		}
+	case info.trusted:
+		// Passed on untouched. A nil value stops the reverse proxy adding to it.
+		if _, ok := h["X-Forwarded-For"]; !ok {
+			h["X-Forwarded-For"] = nil
+		}
+	default:
+		h["X-Forwarded-For"] = nil
+		for _, name := range []string{"X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Prefix"} {
+			h.Del(name)
+		}
+	}
+
+	switch {
+	case info.sendForwarded:
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s", quoteForwardedFor(info.Peer),
+			quoteForwardedValue(info.Host), info.Proto)
+		if info.forwardedHeader != "" {
+			element = info.forwardedHeader + ", " + element
+		}
+		h.Set("Forwarded", element)
+	case !info.trusted:
+		h.Del("Forwarded")
+	}
+}
+
+// parseForwarded splits a Forwarded header into its elements' parameters
+func parseForwarded(value string) []map[string]string {
+	var elements []map[string]string
+	if value == "" {
+		return elements
+	}
+	for _, element := range splitQuoted(value, ',') {
+		params := make(map[string]string)
+		for _, pair := range splitQuoted(element, ';') {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			params[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+		elements = append(elements, params)
+	}
+	return elements
+}
+
+// splitQuoted splits on sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// quoteForwardedFor formats an address for a Forwarded for= parameter. IPv6
+// addresses are bracketed and quoted.
+func quoteForwardedFor(address string) string {
+	if strings.Contains(address, ":") {
+		return fmt.Sprintf(`"[%s]"`, address)
+	}
+	return address
+}
+
+func unquoteForwardedFor(value string) string {
+	value = strings.Trim(value, `"`)
+	if strings.HasPrefix(value, "[") {
+		if end := strings.Index(value, "]"); end > 0 {
+			return value[1:end]
+		}
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return host
+	}
+	return value
+}
+
+// quoteForwardedValue quotes a value if it isn't a plain token, eg a host
+// with a port
+func quoteForwardedValue(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+		}
+	}
+	return value
+}
+
+func firstValue(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(first)
+}
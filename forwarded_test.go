@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// forwardedRequest passes a request from peer through f and returns what the
+// director would send to a node for a service mounted at prefix
+func forwardedRequest(t *testing.T, f *Forwarding, peer, prefix string, header http.Header) (*http.Request, string) {
+	r := httptest.NewRequest("GET", "http://conductor.example.com/api/users", nil)
+	r.RemoteAddr = peer
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	var out *http.Request
+	var client string
+	f.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = clientIP(r)
+		out = r.Clone(r.Context())
+		setForwardedHeaders(out, prefix)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	return out, client
+}
+
+func TestForwardedUntrustedPeer(t *testing.T) {
+	f, _ := NewForwarding("10.0.0.0/8", "x-forwarded,forwarded")
+	req, client := forwardedRequest(t, f, "203.0.113.7:5000", "/api", http.Header{
+		"X-Forwarded-For":   {"1.2.3.4"},
+		"X-Forwarded-Host":  {"evil.example.com"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {"for=1.2.3.4"},
+	})
+	if client != "203.0.113.7" {
+		t.Errorf("Expected a spoofed header to be ignored but the client was '%s'", client)
+	}
+	if _, ok := req.Header["X-Forwarded-For"]; ok {
+		t.Errorf("Expected the spoofed X-Forwarded-For to be dropped but got %v", req.Header["X-Forwarded-For"])
+	}
+	if req.Header.Get("X-Forwarded-Host") != "conductor.example.com" || req.Header.Get("X-Forwarded-Proto") != "http" {
+		t.Errorf("Expected our own host and proto but got '%s' and '%s'",
+			req.Header.Get("X-Forwarded-Host"), req.Header.Get("X-Forwarded-Proto"))
+	}
+	if req.Header.Get("X-Forwarded-Prefix") != "/api" {
+		t.Errorf("Expected the mount point as the prefix but got '%s'", req.Header.Get("X-Forwarded-Prefix"))
+	}
+	if req.Header.Get("Forwarded") != "for=203.0.113.7;host=conductor.example.com;proto=http" {
+		t.Errorf("Unexpected Forwarded header '%s'", req.Header.Get("Forwarded"))
+	}
+}
+
+func TestForwardedTrustedChain(t *testing.T) {
+	f, _ := NewForwarding("10.0.0.0/8, 192.168.1.1", "x-forwarded,forwarded")
+	req, client := forwardedRequest(t, f, "10.1.1.1:5000", "/api", http.Header{
+		"X-Forwarded-For":    {"1.2.3.4, 198.51.100.2", "192.168.1.1"},
+		"X-Forwarded-Host":   {"www.example.com"},
+		"X-Forwarded-Proto":  {"https"},
+		"X-Forwarded-Prefix": {"/edge/"},
+		"Forwarded":          {`for="[2001:db8::1]";proto=https`},
+	})
+	// 192.168.1.1 is trusted, so it is believed about 198.51.100.2
+	if client != "198.51.100.2" {
+		t.Errorf("Expected the first untrusted address but got '%s'", client)
+	}
+	if req.Header.Get("X-Forwarded-For") != "1.2.3.4, 198.51.100.2, 192.168.1.1" {
+		t.Errorf("Expected the chain to be kept but got '%s'", req.Header.Get("X-Forwarded-For"))
+	}
+	if req.Header.Get("X-Forwarded-Host") != "www.example.com" || req.Header.Get("X-Forwarded-Proto") != "https" {
+		t.Errorf("Expected the trusted host and proto but got '%s' and '%s'",
+			req.Header.Get("X-Forwarded-Host"), req.Header.Get("X-Forwarded-Proto"))
+	}
+	if req.Header.Get("X-Forwarded-Prefix") != "/edge/api" {
+		t.Errorf("Expected the prefixes to be joined but got '%s'", req.Header.Get("X-Forwarded-Prefix"))
+	}
+	expected := `for="[2001:db8::1]";proto=https, for=10.1.1.1;host=www.example.com;proto=https`
+	if req.Header.Get("Forwarded") != expected {
+		t.Errorf("Expected '%s' but got '%s'", expected, req.Header.Get("Forwarded"))
+	}
+}
+
+func TestForwardedHeaderOnly(t *testing.T) {
+	f, _ := NewForwarding("::1", "forwarded")
+	req, client := forwardedRequest(t, f, "[::1]:5000", "/api", http.Header{
+		"Forwarded": {`for=192.0.2.60;proto=https;host=www.example.com, for="[::1]:8080"`},
+	})
+	if client != "192.0.2.60" {
+		t.Errorf("Expected the client from the Forwarded header but got '%s'", client)
+	}
+	if _, ok := req.Header["X-Forwarded-Host"]; ok {
+		t.Errorf("Expected no X-Forwarded headers but got %v", req.Header)
+	}
+	expected := `for=192.0.2.60;proto=https;host=www.example.com, for="[::1]:8080", for="[::1]";host=www.example.com;proto=https`
+	if req.Header.Get("Forwarded") != expected {
+		t.Errorf("Expected '%s' but got '%s'", expected, req.Header.Get("Forwarded"))
+	}
+}
+
+func TestNewForwardingInvalid(t *testing.T) {
+	if _, err := NewForwarding("10.0.0.0/33", "x-forwarded"); err == nil {
+		t.Error("Expected an invalid CIDR to be refused")
+	}
+	if _, err := NewForwarding("", "x-real-ip"); err == nil {
+		t.Error("Expected an unknown header style to be refused")
+	}
+}
+
+func TestForwardedThroughProxy(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer ts.Close()
+	proxy, stop := newTestProxy(t, serviceForTestServer("users", "/api", ts))
+	defer stop()
+
+	f, _ := NewForwarding("10.0.0.0/8", "x-forwarded")
+	handler := f.Wrap(proxy)
+
+	r := httptest.NewRequest("GET", "http://conductor.example.com/api/users", nil)
+	r.RemoteAddr = "203.0.113.7:5000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got.Get("X-Forwarded-For") != "203.0.113.7" {
+		t.Errorf("Expected only the real peer but got '%s'", got.Get("X-Forwarded-For"))
+	}
+
+	r = httptest.NewRequest("GET", "http://conductor.example.com/api/users", nil)
+	r.RemoteAddr = "10.0.0.5:5000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got.Get("X-Forwarded-For") != "1.2.3.4, 10.0.0.5" {
+		t.Errorf("Expected the trusted proxy to be added to the chain but got '%s'", got.Get("X-Forwarded-For"))
+	}
+	if got.Get("X-Forwarded-Prefix") != "/api" {
+		t.Errorf("Expected the mount point as the prefix but got '%s'", got.Get("X-Forwarded-Prefix"))
+	}
+}
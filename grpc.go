@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServiceTypeGRPC mounts a service by gRPC service or method name, eg
+// /helloworld.Greeter or /helloworld.Greeter/SayHello, instead of a URL prefix.
+const ServiceTypeGRPC = "grpc"
+
+// gRPC status codes, see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	GRPCOk                = 0
+	GRPCCanceled          = 1
+	GRPCUnknown           = 2
+	GRPCInvalidArgument   = 3
+	GRPCDeadlineExceeded  = 4
+	GRPCNotFound          = 5
+	GRPCPermissionDenied  = 7
+	GRPCResourceExhausted = 8
+	GRPCUnimplemented     = 12
+	GRPCInternal          = 13
+	GRPCUnavailable       = 14
+	GRPCUnauthenticated   = 16
+)
+
+// IsGRPCRequest checks the content type for application/grpc, application/grpc+proto etc
+func IsGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// GRPCStatusFor maps one of conductor's error responses to a gRPC status code
+func GRPCStatusFor(status int, name string) int {
+	switch name {
+	case "no_matching_mount_point":
+		return GRPCUnimplemented
+	}
+	switch status {
+	case http.StatusBadRequest:
+		return GRPCInvalidArgument
+	case http.StatusUnauthorized:
+		return GRPCUnauthenticated
+	case http.StatusForbidden:
+		return GRPCPermissionDenied
+	case http.StatusNotFound:
+		return GRPCUnimplemented
+	case http.StatusTooManyRequests:
+		return GRPCResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return GRPCUnavailable
+	case http.StatusGatewayTimeout:
+		return GRPCDeadlineExceeded
+	case 499:
+		return GRPCCanceled
+	}
+	if status >= 500 {
+		return GRPCInternal
+	}
+	return GRPCUnknown
+}
+
+// writeGRPCError sends a trailers-only gRPC response. The status goes in the
+// headers since there is no body, which is how gRPC servers report errors
+// before sending any messages.
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", grpcPercentEncode(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcPercentEncode encodes a grpc-message value as the gRPC spec asks
+func grpcPercentEncode(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// ParseGRPCTimeout reads a grpc-timeout header value, eg "100m" or "5S"
+func ParseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// NewGRPCHandler enforces the client's grpc-timeout while the call is proxied
+// so a slow backend turns into DEADLINE_EXCEEDED from conductor.
+func NewGRPCHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if timeout, ok := ParseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// grpcBackend answers like a unary gRPC server, with the status in trailers
+func grpcBackend(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("Grpc-Timeout") != "" {
+		time.Sleep(100 * time.Millisecond)
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message, X-Method")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	w.Header().Set("Grpc-Status", "0")
+	w.Header().Set("Grpc-Message", "")
+	w.Header().Set("X-Method", r.URL.Path)
+}
+
+func newGRPCRequest(t *testing.T, url string) *http.Request {
+	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte{0, 0, 0, 0, 1, 42}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	return req
+}
+
+func TestServicePatternAndRewrite(t *testing.T) {
+	tests := []struct {
+		service  Service
+		pattern  string
+		original string
+		rewrite  string
+	}{
+		{Service{MountPoint: "/solr"}, "/solr/", "/solr/select", "/select"},
+		{Service{MountPoint: "/helloworld.Greeter", Type: ServiceTypeGRPC},
+			"/helloworld.Greeter/", "/helloworld.Greeter/SayHello", "/helloworld.Greeter/SayHello"},
+		{Service{MountPoint: "/helloworld.Greeter/SayHello", Type: ServiceTypeGRPC},
+			"/helloworld.Greeter/SayHello", "/helloworld.Greeter/SayHello", "/helloworld.Greeter/SayHello"},
+	}
+	for _, test := range tests {
+		if p := test.service.Pattern(); p != test.pattern {
+			t.Errorf("Expected pattern '%s' for %s but got '%s'", test.pattern, test.service.MountPoint, p)
+		}
+		if p := test.service.RewritePath(test.original); p != test.rewrite {
+			t.Errorf("Expected '%s' to be rewritten to '%s' but got '%s'", test.original, test.rewrite, p)
+		}
+	}
+}
+
+func TestProxyGRPCKeepsTrailers(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(grpcBackend))
+	backend.Config.Protocols = NewServerProtocols(false, true)
+	backend.Start()
+	defer backend.Close()
+
+	s := serviceForTestServer("greeter", "/helloworld.Greeter", backend)
+	s.Type = ServiceTypeGRPC
+	rp, stop := newTestProxy(t, s)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.Handle(s.Pattern(), NewGRPCHandler(rp))
+	proxy := httptest.NewUnstartedServer(mux)
+	proxy.Config.Protocols = NewServerProtocols(false, true)
+	proxy.Start()
+	defer proxy.Close()
+
+	client := &http.Client{Transport: NewH2CTransport()}
+	res, err := client.Do(newGRPCRequest(t, "h2c://"+proxy.Listener.Addr().String()+"/helloworld.Greeter/SayHello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if !bytes.Equal(body, []byte{0, 0, 0, 0, 1, 42}) {
+		t.Errorf("Expected the message to be echoed but got %v", body)
+	}
+	if res.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("Expected grpc-status 0 in the trailers but got '%s'", res.Trailer.Get("Grpc-Status"))
+	}
+	if res.Trailer.Get("X-Method") != "/helloworld.Greeter/SayHello" {
+		t.Errorf("Expected the backend to see the full method path but got '%s'", res.Trailer.Get("X-Method"))
+	}
+}
+
+func TestGRPCErrorWhenNoHealthyNodes(t *testing.T) {
+	s := Service{Name: "greeter", MountPoint: "/helloworld.Greeter", Type: ServiceTypeGRPC}
+	rp, stop := newTestProxy(t, s)
+	defer stop()
+
+	res := httptest.NewRecorder()
+	rp.ServeHTTP(res, newGRPCRequest(t, "http://conductor/helloworld.Greeter/SayHello"))
+
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected gRPC errors to use HTTP 200 but got %d", res.Code)
+	}
+	if res.Header().Get("Grpc-Status") != "14" {
+		t.Errorf("Expected grpc-status 14 UNAVAILABLE but got '%s'", res.Header().Get("Grpc-Status"))
+	}
+}
+
+func TestJSONErrorWhenNoHealthyNodes(t *testing.T) {
+	s := Service{Name: "solr", MountPoint: "/solr"}
+	rp, stop := newTestProxy(t, s)
+	defer stop()
+
+	res := httptest.NewRecorder()
+	rp.ServeHTTP(res, httptest.NewRequest("GET", "/solr/select", nil))
+
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 but got %d", res.Code)
+	}
+	expected := `{"error":"no_healthy_backends","message":"There are no healthy backends that handle '/select'"}` + "\n"
+	if res.Body.String() != expected {
+		t.Errorf("Expected body '%s' but got '%s'", expected, res.Body.String())
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(grpcBackend))
+	backend.Config.Protocols = NewServerProtocols(false, true)
+	backend.Start()
+	defer backend.Close()
+
+	s := serviceForTestServer("greeter", "/helloworld.Greeter", backend)
+	s.Type = ServiceTypeGRPC
+	rp, stop := newTestProxy(t, s)
+	defer stop()
+
+	// A millisecond is less than the backend sleeps for
+	req := newGRPCRequest(t, "http://conductor/helloworld.Greeter/SayHello")
+	req.Header.Set("Grpc-Timeout", "1m")
+	res := httptest.NewRecorder()
+	NewGRPCHandler(rp).ServeHTTP(res, req)
+
+	if res.Header().Get("Grpc-Status") != "4" {
+		t.Errorf("Expected grpc-status 4 DEADLINE_EXCEEDED but got '%s'", res.Header().Get("Grpc-Status"))
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := map[string]time.Duration{
+		"100m": 100 * time.Millisecond,
+		"5S":   5 * time.Second,
+		"1H":   time.Hour,
+	}
+	for value, expected := range tests {
+		d, ok := ParseGRPCTimeout(value)
+		if !ok || d != expected {
+			t.Errorf("Expected '%s' to be %s but got %s", value, expected, d)
+		}
+	}
+	for _, value := range []string{"", "5", "5x", "-5S", "1234567890S"} {
+		if _, ok := ParseGRPCTimeout(value); ok {
+			t.Errorf("Expected '%s' to be invalid", value)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+)
+
+// NewServerProtocols picks the protocols a listener accepts. HTTP/2 over TLS is
+// negotiated with ALPN, h2c needs clients to use prior knowledge.
+func NewServerProtocols(http2, h2c bool) *http.Protocols {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(http2)
+	protocols.SetUnencryptedHTTP2(h2c)
+	return protocols
+}
+
+// NextProtos returns the ALPN protocols to offer on the TLS listener
+func NextProtos(http2 bool) []string {
+	if http2 {
+		return []string{"h2", "http/1.1"}
+	}
+	return []string{"http/1.1"}
+}
+
+// H2CTransport sends requests for h2c:// URLs to the node as plain HTTP/2
+type H2CTransport struct {
+	transport *http.Transport
+}
+
+func NewH2CTransport() *H2CTransport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Protocols = &http.Protocols{}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &H2CTransport{transport: transport}
+}
+
+func (t *H2CTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.URL.Scheme = "http"
+	return t.transport.RoundTrip(out)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func protoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.Proto))
+}
+
+func getProto(t *testing.T, client *http.Client, url string) string {
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return string(body)
+}
+
+func TestSchemeForH2C(t *testing.T) {
+	tagged := Node{Name: "a", Address: "10.0.0.1", Port: 80, Tags: []string{"h2c"}}
+	plain := Node{Name: "b", Address: "10.0.0.2", Port: 80}
+
+	s := Service{Name: "api"}
+	if s.SchemeFor(tagged) != "h2c" {
+		t.Errorf("Expected node tagged h2c to use h2c but got '%s'", s.SchemeFor(tagged))
+	}
+	if s.SchemeFor(plain) != "http" {
+		t.Errorf("Expected untagged node to use http but got '%s'", s.SchemeFor(plain))
+	}
+
+	s.Backend.TLS = true
+	if s.SchemeFor(tagged) != "https" {
+		t.Errorf("Expected TLS to win over h2c but got '%s'", s.SchemeFor(tagged))
+	}
+}
+
+func TestProxyToH2CBackend(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(protoHandler))
+	backend.Config.Protocols = NewServerProtocols(false, true)
+	backend.Start()
+	defer backend.Close()
+
+	s := serviceForTestServer("grpc", "/grpc", backend)
+	s.Nodes[0].Tags = []string{"h2c"}
+	rp, stop := newTestProxy(t, s)
+	defer stop()
+	proxy := httptest.NewServer(rp)
+	defer proxy.Close()
+
+	if proto := getProto(t, http.DefaultClient, proxy.URL+"/grpc/"); proto != "HTTP/2.0" {
+		t.Errorf("Expected the backend to be reached over HTTP/2.0 but got '%s'", proto)
+	}
+}
+
+func TestH2CListener(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(protoHandler))
+	ts.Config.Protocols = NewServerProtocols(false, true)
+	ts.Start()
+	defer ts.Close()
+
+	client := &http.Client{Transport: NewH2CTransport()}
+	if proto := getProto(t, client, "h2c://"+ts.Listener.Addr().String()+"/"); proto != "HTTP/2.0" {
+		t.Errorf("Expected an h2c request to be served over HTTP/2.0 but got '%s'", proto)
+	}
+
+	if proto := getProto(t, http.DefaultClient, ts.URL); proto != "HTTP/1.1" {
+		t.Errorf("Expected plain HTTP/1.1 to still work but got '%s'", proto)
+	}
+}
+
+func TestTLSListenerNegotiatesHTTP2(t *testing.T) {
+	store := NewCertificateStore()
+	store.SetCertificates("files", []*tls.Certificate{loadTestCertificate(t, "conductor.example.com")})
+	tlsConfig, err := NewTLSConfig(store, "1.2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig.NextProtos = NextProtos(true)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(protoHandler), TLSConfig: tlsConfig,
+		Protocols: NewServerProtocols(true, false)}
+	go server.Serve(tls.NewListener(ln, tlsConfig))
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	if proto := getProto(t, client, "https://"+ln.Addr().String()+"/"); proto != "HTTP/2.0" {
+		t.Errorf("Expected ALPN to pick HTTP/2.0 but got '%s'", proto)
+	}
+}
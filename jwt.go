@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A token naming a key we don't have fetches the JWKS again, but no more often
+// than this
+const jwksMinRefresh = time.Minute
+
+// JWTConfig requires a valid JWT in the Authorization header of every request
+// to a service, eg
+// {"jwks_url": "https://auth.internal/.well-known/jwks.json", "issuer": "https://auth.internal/",
+// "audiences": ["orders"], "claim_headers": {"sub": "X-User-Id"}}
+type JWTConfig struct {
+	// Where the keys come from: a JWKS file or URL. Setting one turns on JWT
+	// verification for the service.
+	JWKSFile string `json:"jwks_file"`
+	JWKSURL  string `json:"jwks_url"`
+	// How long the keys are used before they are loaded again. Defaults to ten
+	// minutes.
+	JWKSRefresh Duration `json:"jwks_refresh"`
+	// The iss the token must have, if set
+	Issuer string `json:"issuer"`
+	// The token's aud must include one of these, if set
+	Audiences []string `json:"audiences"`
+	// Clock skew allowed when checking exp and nbf. Defaults to one minute.
+	Leeway Duration `json:"leeway"`
+	// Claims passed to the node as headers, eg {"sub": "X-User-Id"}. Clients
+	// can't send these headers themselves.
+	ClaimHeaders map[string]string `json:"claim_headers"`
+}
+
+func (c JWTConfig) enabled() bool {
+	return c.JWKSFile != "" || c.JWKSURL != ""
+}
+
+// verificationKey is a key from a JWKS: a []byte secret for HS256, an
+// *rsa.PublicKey for RS256 or an *ecdsa.PublicKey for ES256
+type verificationKey struct {
+	id  string
+	alg string
+	key interface{}
+}
+
+// KeySet holds the keys from a JWKS file or URL. Keys older than refresh are
+// still used while they are loaded again in the background.
+type KeySet struct {
+	mu          sync.Mutex
+	keys        []verificationKey
+	loadedAt    time.Time
+	attemptedAt time.Time
+	loading     bool
+	// Only one load at a time
+	loadMu  sync.Mutex
+	file    string
+	url     string
+	refresh time.Duration
+	client  *http.Client
+	now     func() time.Time
+}
+
+func NewKeySet(file, url string, refresh time.Duration) *KeySet {
+	if refresh == 0 {
+		refresh = 10 * time.Minute
+	}
+	return &KeySet{file: file, url: url, refresh: refresh,
+		client: &http.Client{Timeout: 10 * time.Second}, now: time.Now}
+}
+
+// Keys returns the keys that could have signed a token with this kid. An
+// unknown kid means the keys may have been rotated, so they are loaded again.
+func (k *KeySet) Keys(kid string) []verificationKey {
+	k.mu.Lock()
+	var keys []verificationKey
+	for _, key := range k.keys {
+		if kid == "" || key.id == "" || key.id == kid {
+			keys = append(keys, key)
+		}
+	}
+	now := k.now()
+	canLoad := now.Sub(k.attemptedAt) >= jwksMinRefresh
+	stale := now.Sub(k.loadedAt) >= k.refresh && canLoad && !k.loading
+	if stale {
+		k.loading = true
+	}
+	k.mu.Unlock()
+
+	switch {
+	case len(keys) == 0 && canLoad:
+		k.Load()
+		return k.Keys(kid)
+	case stale:
+		go k.Load()
+	}
+	return keys
+}
+
+// Load reads the JWKS again. If it can't be read the old keys are kept.
+func (k *KeySet) Load() error {
+	k.loadMu.Lock()
+	defer k.loadMu.Unlock()
+	k.mu.Lock()
+	if !k.attemptedAt.IsZero() && k.now().Sub(k.attemptedAt) < jwksMinRefresh {
+		// Someone else just loaded them
+		k.loading = false
+		k.mu.Unlock()
+		return nil
+	}
+	k.attemptedAt = k.now()
+	k.mu.Unlock()
+
+	keys, err := k.read()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.loading = false
+	if err != nil {
+		log.WithFields(log.Fields{"jwks_file": k.file, "jwks_url": k.url,
+			"error": err}).Error("Could not load JWKS, keeping the old keys")
+		return err
+	}
+	k.keys, k.loadedAt = keys, k.now()
+	log.WithFields(log.Fields{"jwks_file": k.file, "jwks_url": k.url,
+		"keys": len(keys)}).Debug("Loaded JWKS")
+	return nil
+}
+
+func (k *KeySet) read() ([]verificationKey, error) {
+	if k.file != "" {
+		body, err := os.ReadFile(k.file)
+		if err != nil {
+			return nil, err
+		}
+		return parseJWKS(body)
+	}
+	res, err := k.client.Get(k.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS URL answered %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(body)
+}
+
+// parseJWKS reads the signing keys we can use from a JWKS and skips the rest
+func parseJWKS(body []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %s", err)
+	}
+	var keys []verificationKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key verificationKey
+		var err error
+		switch jwk.Kty {
+		case "oct":
+			key.alg = "HS256"
+			key.key, err = base64.RawURLEncoding.DecodeString(jwk.K)
+		case "RSA":
+			key.alg = "RS256"
+			key.key, err = rsaPublicKey(jwk.N, jwk.E)
+		case "EC":
+			key.alg = "ES256"
+			if jwk.Crv != "P-256" {
+				err = fmt.Errorf("unsupported curve '%s'", jwk.Crv)
+				break
+			}
+			key.key, err = ecdsaPublicKey(jwk.X, jwk.Y)
+		default:
+			continue
+		}
+		if jwk.Alg != "" && jwk.Alg != key.alg {
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"kid": jwk.Kid, "error": err}).Warn("Skipping invalid JWKS key")
+			continue
+		}
+		key.id = jwk.Kid
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func rsaPublicKey(n, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}
+	if key.N.BitLen() < 2048 || key.E < 3 {
+		return nil, errors.New("RSA key too weak")
+	}
+	return key, nil
+}
+
+func ecdsaPublicKey(x, y string) (*ecdsa.PublicKey, error) {
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	if len(xBytes) != 32 || len(yBytes) != 32 {
+		return nil, errors.New("P-256 coordinates must be 32 bytes")
+	}
+	// ecdh checks the point is on the curve
+	if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, xBytes...), yBytes...)); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}, nil
+}
+
+// JWTVerifier checks tokens against a service's JWT configuration
+type JWTVerifier struct {
+	config JWTConfig
+	keys   *KeySet
+	now    func() time.Time
+}
+
+func NewJWTVerifier(c JWTConfig) *JWTVerifier {
+	if c.Leeway.Duration == 0 {
+		c.Leeway.Duration = time.Minute
+	}
+	return &JWTVerifier{config: c, keys: NewKeySet(c.JWKSFile, c.JWKSURL, c.JWKSRefresh.Duration), now: time.Now}
+}
+
+// Verify checks the token's signature and claims and returns the claims
+func (v *JWTVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %s", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if header.Alg != "HS256" && header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, fmt.Errorf("unsupported algorithm '%s'", header.Alg)
+	}
+
+	verified := false
+	for _, key := range v.keys.Keys(header.Kid) {
+		// The key decides the algorithm, so an RSA public key can't be used as
+		// an HMAC secret
+		if key.alg == header.Alg && verifySignature(key, parts[0]+"."+parts[1], signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %s", err)
+	}
+	return claims, v.checkClaims(claims)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
+
+func verifySignature(key verificationKey, signed string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+	switch k := key.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS signatures are r and s side by side rather than ASN.1
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k, digest[:], r, s)
+	}
+	return false
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) error {
+	now := v.now()
+	leeway := v.config.Leeway.Duration
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-leeway)) {
+		return errors.New("token not valid yet")
+	}
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return fmt.Errorf("wrong issuer '%v'", claims["iss"])
+	}
+	if len(v.config.Audiences) > 0 && !hasAudience(claims["aud"], v.config.Audiences) {
+		return fmt.Errorf("wrong audience '%v'", claims["aud"])
+	}
+	return nil
+}
+
+// hasAudience checks an aud claim, which is a string or a list of them
+func hasAudience(aud interface{}, audiences []string) bool {
+	var values []interface{}
+	switch a := aud.(type) {
+	case string:
+		values = []interface{}{a}
+	case []interface{}:
+		values = a
+	}
+	for _, value := range values {
+		for _, audience := range audiences {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimHeaderValue formats a claim for a header. Lists of strings are comma
+// separated and anything else that isn't a string is JSON.
+func claimHeaderValue(claim interface{}) string {
+	switch c := claim.(type) {
+	case string:
+		return c
+	case []interface{}:
+		values := make([]string, 0, len(c))
+		for _, value := range c {
+			s, ok := value.(string)
+			if !ok {
+				encoded, _ := json.Marshal(c)
+				return string(encoded)
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ",")
+	}
+	encoded, _ := json.Marshal(claim)
+	return string(encoded)
+}
+
+// NewJWTHandler turns away requests to the service without a valid bearer
+// token, and passes the configured claims on to the node as headers
+func NewJWTHandler(s Service, handler http.Handler) http.Handler {
+	if !s.JWT.enabled() {
+		return handler
+	}
+	verifier := NewJWTVerifier(s.JWT)
+	verifier.keys.Load()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range s.JWT.ClaimHeaders {
+			r.Header.Del(name)
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			unauthorized(w, r, "missing bearer token")
+			return
+		}
+		claims, err := verifier.Verify(strings.TrimSpace(token))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			unauthorized(w, r, err.Error())
+			return
+		}
+		for claim, name := range s.JWT.ClaimHeaders {
+			if value, ok := claims[claim]; ok {
+				r.Header.Set(name, claimHeaderValue(value))
+			}
+		}
+		if entry := accessLogEntryFrom(r); entry != nil {
+			if sub, ok := claims["sub"].(string); ok {
+				entry.User = sub
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAKey  *rsa.PrivateKey
+	testECKey   *ecdsa.PrivateKey
+	testHMACKey = []byte("a shared secret that is long enough")
+	testKeyOnce sync.Once
+)
+
+func testJWTKeys(t *testing.T) {
+	testKeyOnce.Do(func() {
+		var err error
+		if testRSAKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+		if testECKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// testJWKS returns a JWKS with the test keys under the given kids
+func testJWKS(t *testing.T, rsaKid, ecKid, hmacKid string) []byte {
+	testJWTKeys(t)
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": rsaKid, "n": b64(testRSAKey.N.Bytes()),
+			"e": b64(big.NewInt(int64(testRSAKey.E)).Bytes())},
+		{"kty": "EC", "kid": ecKid, "crv": "P-256",
+			"x": b64(testECKey.X.FillBytes(make([]byte, 32))), "y": b64(testECKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "oct", "kid": hmacKid, "k": b64(testHMACKey)},
+	}
+	body, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return body
+}
+
+// signJWT makes a token signed with the test key for alg
+func signJWT(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	testJWTKeys(t)
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, testHMACKey)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, testRSAKey, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, testECKey, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(signature)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{"sub": "user-42", "iss": "https://auth.internal/", "aud": []string{"orders"},
+		"exp": time.Now().Add(time.Hour).Unix(), "roles": []string{"admin", "ops"}}
+}
+
+func newTestJWTHandler(t *testing.T, c JWTConfig) (http.Handler, *http.Header) {
+	got := &http.Header{}
+	s := Service{Name: "orders", MountPoint: "/orders", JWT: c}
+	return NewJWTHandler(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = r.Header.Clone()
+	})), got
+}
+
+func jwtRequest(handler http.Handler, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/orders/1", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	r.Header.Set("X-User-Id", "spoofed")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+	return res
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "jwks.json")
+	os.WriteFile(file, testJWKS(t, "rsa-1", "ec-1", "hmac-1"), 0600)
+	handler, got := newTestJWTHandler(t, JWTConfig{JWKSFile: file, Issuer: "https://auth.internal/",
+		Audiences: []string{"orders"}, ClaimHeaders: map[string]string{"sub": "X-User-Id", "roles": "X-Roles"}})
+
+	for alg, kid := range map[string]string{"RS256": "rsa-1", "ES256": "ec-1", "HS256": "hmac-1"} {
+		*got = nil
+		res := jwtRequest(handler, signJWT(t, alg, kid, validClaims()))
+		if res.Code != http.StatusOK {
+			t.Errorf("Expected a valid %s token to be let through but got %d %s", alg, res.Code, res.Body.String())
+			continue
+		}
+		if got.Get("X-User-Id") != "user-42" || got.Get("X-Roles") != "admin,ops" {
+			t.Errorf("Expected the %s claims as headers but got '%s' and '%s'", alg,
+				got.Get("X-User-Id"), got.Get("X-Roles"))
+		}
+	}
+}
+
+func TestJWTRejected(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "jwks.json")
+	os.WriteFile(file, testJWKS(t, "rsa-1", "ec-1", "hmac-1"), 0600)
+	handler, got := newTestJWTHandler(t, JWTConfig{JWKSFile: file, Issuer: "https://auth.internal/",
+		Audiences: []string{"orders"}, ClaimHeaders: map[string]string{"sub": "X-User-Id"}})
+
+	claims := func(name string, value interface{}) map[string]interface{} {
+		c := validClaims()
+		c[name] = value
+		return c
+	}
+	valid := signJWT(t, "RS256", "rsa-1", validClaims())
+	parts := strings.Split(valid, ".")
+	unsigned, _ := json.Marshal(map[string]string{"alg": "none"})
+
+	tests := map[string]string{
+		"missing":           "",
+		"garbage":           "not.a.token",
+		"expired":           signJWT(t, "RS256", "rsa-1", claims("exp", time.Now().Add(-time.Hour).Unix())),
+		"not yet valid":     signJWT(t, "ES256", "ec-1", claims("nbf", time.Now().Add(time.Hour).Unix())),
+		"wrong issuer":      signJWT(t, "HS256", "hmac-1", claims("iss", "https://evil.example.com/")),
+		"wrong audience":    signJWT(t, "RS256", "rsa-1", claims("aud", "billing")),
+		"tampered":          parts[0] + "." + b64([]byte(`{"sub":"admin"}`)) + "." + parts[2],
+		"alg none":          b64(unsigned) + "." + parts[1] + ".",
+		"wrong key for alg": signJWT(t, "HS256", "rsa-1", validClaims()),
+	}
+	for name, token := range tests {
+		*got = nil
+		res := jwtRequest(handler, token)
+		if res.Code != http.StatusUnauthorized || *got != nil {
+			t.Errorf("%s: expected a 401 but got %d", name, res.Code)
+		}
+		if !strings.HasPrefix(res.Body.String(), `{"error":"unauthorized","message":"A valid token is required for '/orders/1'"`) {
+			t.Errorf("%s: unexpected body %s", name, res.Body.String())
+		}
+		if !strings.HasPrefix(res.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%s: expected a bearer challenge but got '%s'", name, res.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestJWKSURLRotation(t *testing.T) {
+	var mu sync.Mutex
+	jwks := testJWKS(t, "rsa-1", "ec-1", "hmac-1")
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		w.Write(jwks)
+	}))
+	defer ts.Close()
+
+	verifier := NewJWTVerifier(JWTConfig{JWKSURL: ts.URL})
+	now := time.Now()
+	verifier.keys.now = func() time.Time { return now }
+	if _, err := verifier.Verify(signJWT(t, "ES256", "ec-1", validClaims())); err != nil {
+		t.Fatalf("Expected the token to be verified with fetched keys but got %s", err)
+	}
+
+	// The keys are rotated. A token with the new kid fetches them again, but
+	// only once a minute has passed since the last fetch.
+	mu.Lock()
+	jwks = testJWKS(t, "rsa-2", "ec-2", "hmac-2")
+	mu.Unlock()
+	rotated := signJWT(t, "ES256", "ec-2", validClaims())
+	if _, err := verifier.Verify(rotated); err == nil {
+		t.Error("Expected an unknown kid to be refused until the keys can be fetched again")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := verifier.Verify(rotated); err != nil {
+		t.Errorf("Expected the rotated key to be fetched but got %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 2 {
+		t.Errorf("Expected the JWKS to be fetched twice but it was fetched %d times", fetches)
+	}
+}
+
+func TestParseJWKSSkipsUnusableKeys(t *testing.T) {
+	body := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "%s", "e": "AQAB"},
+		{"kty": "RSA", "kid": "small", "n": "AQAB", "e": "AQAB"},
+		{"kty": "EC", "kid": "p384", "crv": "P-384", "x": "AA", "y": "AA"},
+		{"kty": "OKP", "kid": "ed", "x": "AA"},
+		{"kty": "oct", "kid": "hs512", "alg": "HS512", "k": "c2VjcmV0"},
+		{"kty": "oct", "kid": "ok", "k": "c2VjcmV0"}
+	]}`, b64(make([]byte, 256)))
+	keys, err := parseJWKS([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].id != "ok" {
+		t.Errorf("Expected only the usable key but got %v", keys)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
 )
@@ -12,7 +14,8 @@ type LoadBalancer struct {
 	BuilderFunction func(Service) func() url.URL
 	// Services holds the mount point to loadbalancer function mapping
 	Services ServiceList
-	// Keys are mount points, values are the loadbalancing function for that service
+	// Keys are Service.Key(), the mount point plus the version for split
+	// versions. Values are the reverse proxy for that service.
 	MountPointToReverseProxyMap map[string]*httputil.ReverseProxy
 
 	// List of all the workers
@@ -26,11 +29,30 @@ func NewLoadBalancer(services *ServiceList, builder func(Service) func() url.URL
 }
 
 // Builds the HTTP Proxy map like so: {"/solr": http.HandlerFunc()}
-func (lb *LoadBalancer) GenerateReverseProxyMap() {
+func (lb *LoadBalancer) GenerateReverseProxyMap() error {
 	lb.MountPointToReverseProxyMap = make(map[string]*httputil.ReverseProxy)
-	for mountPoint, w := range lb.Workers {
-		lb.MountPointToReverseProxyMap[mountPoint] = NewReverseProxyWithLoadBalancer(mountPoint, w.RequestChan)
+	for _, s := range lb.Services {
+		transport, err := NewBackendTransport(s.Backend)
+		if err != nil {
+			return fmt.Errorf("service '%s': %s", s.Name, err)
+		}
+		w := lb.Workers[s.Key()]
+		lb.MountPointToReverseProxyMap[s.Key()] = NewReverseProxyWithLoadBalancer(*s, w.RequestChan, transport)
+	}
+	return nil
+}
+
+// ProxyFor returns the handler for a mount point. Services with a split get a
+// Splitter in front of the proxies for each version.
+func (lb *LoadBalancer) ProxyFor(s *Service) http.Handler {
+	if len(s.Split.Versions) == 0 {
+		return lb.MountPointToReverseProxyMap[s.Key()]
+	}
+	proxies := map[string]http.Handler{StableVersion: lb.MountPointToReverseProxyMap[s.Key()]}
+	for _, v := range s.VersionServices() {
+		proxies[v.Version] = lb.MountPointToReverseProxyMap[v.Key()]
 	}
+	return NewSplitter(*s, proxies)
 }
 
 func (lb *LoadBalancer) StartWorkers() {
@@ -38,9 +60,10 @@ func (lb *LoadBalancer) StartWorkers() {
 	lb.Workers = make(map[string]*LoadBalancerWorker)
 	for _, s := range lb.Services {
 		log.WithFields(log.Fields{"mount_point": s.MountPoint,
+			"version": s.Version,
 			"service": s.Name}).Debug("Starting Loadbalancer Worker")
 		w := NewLoadBalancerWorker(lb.BuilderFunction)
-		lb.Workers[s.MountPoint] = w
+		lb.Workers[s.Key()] = w
 		go w.Work(*s)
 	}
 }
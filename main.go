@@ -1,25 +1,57 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const Version = "0.2.5"
 const CodeName = "The Canadian Dream"
 
 type Config struct {
-	ConsulHost       string
-	ConsulDataCenter string
-	LoadBalancer     string
-	LogLevel         string
-	LogFormat        string
-	KVPrefix         string
-	Port             int
-	Version          bool
+	ConsulHost         string
+	ConsulDataCenter   string
+	LoadBalancer       string
+	LogLevel           string
+	LogFormat          string
+	KVPrefix           string
+	Port               int
+	Version            bool
+	DrainTimeout       time.Duration
+	TLSPort            int
+	TLSCertFiles       string
+	TLSKeyFiles        string
+	TLSMinVersion      string
+	TLSCiphers         string
+	TLSRedirect        bool
+	TLSReload          time.Duration
+	TLSKVPrefix        string
+	TLSCertDir         string
+	UpgradeIdleTimeout time.Duration
+	HTTP2              bool
+	H2C                bool
+	PeerService        string
+	AdminAddress       string
+	AccessLog          string
+	AccessLogFormat    string
+	AccessLogSample    float64
+	TraceEndpoint      string
+	TraceServiceName   string
+	TraceSample        float64
+	RequestIDHeader    string
+	TrustedProxies     string
+	ForwardedHeaders   string
+	ProxyProtocol      string
 }
 
 // Initialize the Configuration struct
@@ -43,6 +75,53 @@ func init() {
 		"The Key Value prefix in consul to search for services under")
 	flag.IntVar(&config.Port, "port", 8888, "Listen on this port")
 	flag.BoolVar(&config.Version, "version", false, "Print version and exit")
+	flag.DurationVar(&config.DrainTimeout, "drain-timeout", 30*time.Second,
+		"How long to wait for in-flight requests when shutting down or upgrading")
+	flag.DurationVar(&config.UpgradeIdleTimeout, "upgrade-idle-timeout", 10*time.Minute,
+		"Close upgraded connections, eg WebSockets, after this long with no traffic")
+	flag.BoolVar(&config.HTTP2, "http2", true, "Accept HTTP/2 on the TLS listener, negotiated with ALPN")
+	flag.BoolVar(&config.H2C, "h2c", false, "Accept HTTP/2 without TLS (prior knowledge h2c) on --port")
+	flag.StringVar(&config.PeerService, "peer-service", "conductor",
+		"Consul service name conductor registers under to share global rate limits with its peers")
+	flag.StringVar(&config.AdminAddress, "admin-address", "",
+		"Serve the admin API, eg fault injection, on this address like 127.0.0.1:8889 (disabled when empty)")
+	flag.StringVar(&config.AccessLog, "access-log", "stdout",
+		"Write the access log to stdout, stderr or this file (disabled when 'off')")
+	flag.StringVar(&config.AccessLogFormat, "access-log-format", "combined",
+		"Access log format: 'combined', 'json' or a template like '{{.Method}} {{.Path}} {{.Status}} {{.Duration}}'")
+	flag.Float64Var(&config.AccessLogSample, "access-log-sample", 1,
+		"Share of requests to write to the access log, from 0 to 1. Server errors are always written.")
+	flag.StringVar(&config.TrustedProxies, "trusted-proxies", "",
+		"Comma separated CIDRs of proxies in front of conductor whose forwarding headers are believed")
+	flag.StringVar(&config.ForwardedHeaders, "forwarded-headers", "x-forwarded",
+		"Forwarding headers to send to nodes: x-forwarded, forwarded, both as 'x-forwarded,forwarded', or none")
+	flag.StringVar(&config.ProxyProtocol, "proxy-protocol", "",
+		"Comma separated CIDRs of load balancers that may send a PROXY protocol header on --port and --tls-port (disabled when empty)")
+	flag.StringVar(&config.RequestIDHeader, "request-id-header", "X-Request-Id",
+		"Header that carries the request ID to the node and back to the client")
+	flag.StringVar(&config.TraceEndpoint, "trace-endpoint", "",
+		"Export spans to this OpenTelemetry collector over OTLP/HTTP, eg http://otel-collector:4318 (disabled when empty)")
+	flag.StringVar(&config.TraceServiceName, "trace-service-name", "conductor",
+		"The service.name spans are exported under")
+	flag.Float64Var(&config.TraceSample, "trace-sample", 1,
+		"Share of new traces to sample, from 0 to 1. Requests already in a trace follow the caller.")
+	flag.IntVar(&config.TLSPort, "tls-port", 0, "Serve HTTPS on this port (disabled when 0)")
+	flag.StringVar(&config.TLSCertFiles, "tls-cert", "",
+		"Comma separated list of PEM certificate files, picked by SNI")
+	flag.StringVar(&config.TLSKeyFiles, "tls-key", "",
+		"Comma separated list of PEM key files, in the same order as --tls-cert")
+	flag.StringVar(&config.TLSMinVersion, "tls-min-version", "1.2",
+		"Minimum TLS version to accept (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&config.TLSCiphers, "tls-ciphers", "",
+		"Comma separated list of cipher suites to allow for TLS 1.2 and below (Go defaults when empty)")
+	flag.BoolVar(&config.TLSRedirect, "tls-redirect", false,
+		"Redirect plain HTTP requests on --port to HTTPS")
+	flag.DurationVar(&config.TLSReload, "tls-reload-interval", 10*time.Second,
+		"How often to check certificate files for changes")
+	flag.StringVar(&config.TLSKVPrefix, "tls-kv-prefix", "",
+		"Watch this Consul KV prefix for PEM bundles keyed by host name")
+	flag.StringVar(&config.TLSCertDir, "tls-cert-dir", "",
+		"Watch this directory for PEM bundles named by host name, eg secrets rendered by a Vault agent")
 
 	flag.Parse()
 
@@ -53,6 +132,20 @@ func init() {
 	override_with_env_var(&config.LoadBalancer, "LOADBALANCER")
 	override_with_env_var(&config.LogFormat, "LOG_FORMAT")
 	override_with_env_var(&config.LogLevel, "LOG_LEVEL")
+	override_with_env_var(&config.TLSCertFiles, "TLS_CERT")
+	override_with_env_var(&config.TLSKeyFiles, "TLS_KEY")
+	override_with_env_var(&config.TLSKVPrefix, "TLS_KV_PREFIX")
+	override_with_env_var(&config.TLSCertDir, "TLS_CERT_DIR")
+	override_with_env_var(&config.PeerService, "PEER_SERVICE")
+	override_with_env_var(&config.AdminAddress, "ADMIN_ADDRESS")
+	override_with_env_var(&config.AccessLog, "ACCESS_LOG")
+	override_with_env_var(&config.AccessLogFormat, "ACCESS_LOG_FORMAT")
+	override_with_env_var(&config.RequestIDHeader, "REQUEST_ID_HEADER")
+	override_with_env_var(&config.TrustedProxies, "TRUSTED_PROXIES")
+	override_with_env_var(&config.ForwardedHeaders, "FORWARDED_HEADERS")
+	override_with_env_var(&config.ProxyProtocol, "PROXY_PROTOCOL")
+	override_with_env_var(&config.TraceEndpoint, "TRACE_ENDPOINT")
+	override_with_env_var(&config.TraceServiceName, "TRACE_SERVICE_NAME")
 
 	logLevelMap := map[string]log.Level{
 		"debug": log.DebugLevel,
@@ -124,6 +217,10 @@ func main() {
 		"data_center": config.ConsulDataCenter,
 		"kv_prefix":   config.KVPrefix}).Debug("Pulling healthy nodes for services")
 
+	// Each version in a split, each mirror and each authorization service is
+	// balanced as a service of its own
+	serviceList = serviceList.WithVersions().WithMirrors().WithAuthServices()
+
 	// Pull the healthy nodes
 	serviceList, err = consul.GetAllHealthyNodes(serviceList)
 	if err != nil {
@@ -140,42 +237,315 @@ func main() {
 	// Laucnch loadbalancers
 	lb := NewLoadBalancer(serviceList, NewNiaveRoundRobin)
 	lb.StartWorkers()
-	lb.GenerateReverseProxyMap()
+	if err := lb.GenerateReverseProxyMap(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Could not set up backend connections")
+		os.Exit(1)
+	}
 
 	healthWorkers := make(map[string]*ConsulHealthWorker)
 
 	// Launch health workers
 	for _, service := range lb.Services {
 		log.WithFields(log.Fields{"service": service.Name,
+			"version":     service.Version,
 			"mount_point": service.MountPoint}).Debug("Starting consul health worker")
-		lbw := lb.Workers[service.MountPoint]
+		lbw := lb.Workers[service.Key()]
 		worker := NewConsulHealthWorker(consul, *service, lbw)
-		healthWorkers[service.MountPoint] = worker
+		healthWorkers[service.Key()] = worker
 		go worker.Work()
 	}
 
-	for mp, rp := range lb.MountPointToReverseProxyMap {
+	peers := NewPeers()
+	var peerWorker *ConsulPeerWorker
+	if UsesGlobalRateLimits(lb.Services) {
+		peerWorker = NewConsulPeerWorker(consul, peers, config.PeerService, config.Port)
+		if err := peerWorker.Register(); err != nil {
+			log.WithFields(log.Fields{"error": err,
+				"peer_service": config.PeerService}).Error("Could not register with consul for global rate limits")
+			os.Exit(1)
+		}
+		go peerWorker.Work()
+	}
+
+	upgrades := NewUpgradeTracker()
+	faults := NewFaults()
+	access := NewAccess()
+	var serviceWorkers []*ConsulServiceWorker
+	mirrors := make(map[string]*Mirror)
+	for _, service := range lb.Services {
+		if service.Version != "" {
+			// Served through the split, mirror or auth request on the service's
+			// mount point
+			continue
+		}
+		mp := service.MountPoint
 		log.WithFields(log.Fields{"mount_point": mp}).Debug("Adding mountpoint handler function")
-		http.HandleFunc(fmt.Sprintf("%s/", mp), rp.ServeHTTP)
+		// Every service picks up fault and access rules as its definition changes
+		subscribers := []func(Service){faults.Update, access.Update}
+		proxy := lb.ProxyFor(service)
+		if splitter, ok := proxy.(*Splitter); ok {
+			subscribers = append(subscribers, splitter.Update)
+		}
+		if shadow := service.MirrorService(); shadow != nil {
+			mirror := NewMirror(*service, lb.MountPointToReverseProxyMap[shadow.Key()], proxy)
+			mirrors[mp] = mirror
+			subscribers = append(subscribers, mirror.Update)
+			proxy = mirror
+		}
+		w := NewConsulServiceWorker(consul, *service)
+		for _, subscriber := range subscribers {
+			w.Subscribe(subscriber)
+		}
+		serviceWorkers = append(serviceWorkers, w)
+		go w.Work()
+		var auth http.Handler
+		if authService := service.AuthService(); authService != nil {
+			auth = lb.MountPointToReverseProxyMap[authService.Key()]
+		}
+		http.Handle(service.Pattern(), NewServiceHandler(*service, proxy, auth, upgrades, peers, faults, access))
 	}
 
 	http.HandleFunc("/", noMatchingMountPointHandler)
 	http.HandleFunc("/_ping", pingHandler)
 
-	log.WithFields(log.Fields{
-		"port":    config.Port,
-		"address": "0.0.0.0",
-		"status":  "running",
-	}).Info("Up and running")
+	listeners, err := NewListeners()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Could not inherit listeners from parent process")
+		os.Exit(1)
+	}
 
 	// Start listening
-	err = http.ListenAndServe(fmt.Sprintf(":%d", config.Port), nil)
+	ln, err := listeners.Listen("http", fmt.Sprintf(":%d", config.Port))
 	if err != nil {
 		log.Fatal(err)
 	}
+	ln = withProxyProtocol(ln)
+
+	var tracer *Tracer
+	var spanExporter *SpanExporter
+	if config.TraceEndpoint != "" {
+		spanExporter = NewSpanExporter(config.TraceEndpoint, config.TraceServiceName)
+		go spanExporter.Work()
+		tracer = NewTracer(spanExporter, config.TraceSample)
+	}
+	var accessLog *AccessLog
+	if config.AccessLog != "off" {
+		accessLog, err = NewAccessLog(config.AccessLog, config.AccessLogFormat, config.AccessLogSample)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "access_log": config.AccessLog}).Error("Could not open access log")
+			os.Exit(1)
+		}
+	}
+	requestIDs := NewRequestIDs(config.RequestIDHeader)
+	forwarding, err := NewForwarding(config.TrustedProxies, config.ForwardedHeaders)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid forwarding configuration")
+		os.Exit(1)
+	}
+
+	// What every request goes through before it reaches a mount point. The
+	// first wrapper here is the last to see the request.
+	wrap := func(handler http.Handler) http.Handler {
+		if tracer != nil {
+			handler = tracer.Wrap(handler)
+		}
+		if accessLog != nil {
+			handler = accessLog.Wrap(handler)
+		}
+		handler = requestIDs.Wrap(handler)
+		// Everything else needs to know who the client is
+		return forwarding.Wrap(handler)
+	}
+	handler := wrap(http.DefaultServeMux)
+
+	server := &http.Server{Handler: handler, Protocols: NewServerProtocols(false, config.H2C)}
+	if config.TLSPort != 0 && config.TLSRedirect {
+		server.Handler = wrap(NewHTTPSRedirectHandler(config.TLSPort))
+	}
+	servers := []*http.Server{server}
+
+	var certWorker *CertificateFileWorker
+	var certKVWorkers []*CertificateKVWorker
+	if config.TLSPort != 0 {
+		var tlsServer *http.Server
+		tlsServer, certWorker, certKVWorkers = startTLS(listeners, consul, handler)
+		servers = append(servers, tlsServer)
+	}
+	if config.AdminAddress != "" {
+		servers = append(servers, startAdmin(listeners, faults, mirrors, upgrades))
+	}
+	listeners.CloseUnused()
+
+	go serve(server, ln)
+
+	log.WithFields(log.Fields{
+		"port":     config.Port,
+		"tls_port": config.TLSPort,
+		"address":  "0.0.0.0",
+		"status":   "running",
+	}).Info("Up and running")
+
+	if err := NotifyParent(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Could not notify parent process")
+	}
+
+	waitForSignals(listeners, servers, certWorker, accessLog, upgrades)
+	if certWorker != nil {
+		certWorker.ControlChan <- true
+	}
+	for _, w := range certKVWorkers {
+		w.ControlChan <- true
+	}
+	if peerWorker != nil {
+		peerWorker.Stop(5 * time.Second)
+	}
+	for _, w := range serviceWorkers {
+		w.ControlChan <- true
+	}
+	if spanExporter != nil {
+		spanExporter.Stop()
+	}
 	exit(lb, healthWorkers)
 }
 
+// startTLS loads our certificates and starts serving HTTPS
+func startTLS(listeners *Listeners, consul *Consul, handler http.Handler) (*http.Server, *CertificateFileWorker, []*CertificateKVWorker) {
+	pairs, err := ParseCertificatePairs(config.TLSCertFiles, config.TLSKeyFiles)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid TLS certificate configuration")
+	}
+
+	store := NewCertificateStore()
+	certWorker := NewCertificateFileWorker(store, pairs, config.TLSReload)
+	if err := certWorker.Load(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Could not load TLS certificates")
+	}
+	go certWorker.Work()
+
+	var kvWorkers []*CertificateKVWorker
+	if config.TLSKVPrefix != "" {
+		kvWorkers = append(kvWorkers,
+			NewCertificateKVWorker("consul_kv", consul.Client.KV(), config.TLSKVPrefix, store))
+	}
+	if config.TLSCertDir != "" {
+		kvWorkers = append(kvWorkers,
+			NewCertificateKVWorker("secret_dir", NewSecretDirectory(config.TLSCertDir), "secrets", store))
+	}
+	for _, w := range kvWorkers {
+		if err := w.Load(); err != nil {
+			log.WithFields(log.Fields{"source": w.source, "error": err}).Fatal("Could not load TLS certificates")
+		}
+		go w.Work()
+	}
+
+	tlsConfig, err := NewTLSConfig(store, config.TLSMinVersion, config.TLSCiphers)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid TLS configuration")
+	}
+
+	ln, err := listeners.Listen("https", fmt.Sprintf(":%d", config.TLSPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = withProxyProtocol(ln)
+
+	tlsConfig.NextProtos = NextProtos(config.HTTP2)
+	server := &http.Server{Handler: handler, TLSConfig: tlsConfig, Protocols: NewServerProtocols(config.HTTP2, false)}
+	go serve(server, tls.NewListener(ln, tlsConfig))
+	return server, certWorker, kvWorkers
+}
+
+// startAdmin serves the admin API. It can change how requests are handled, so
+// it gets a listener of its own that can be kept off the public network.
+func startAdmin(listeners *Listeners, faults *Faults, mirrors map[string]*Mirror, upgrades *UpgradeTracker) *http.Server {
+	ln, err := listeners.Listen("admin", config.AdminAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/_admin/faults", NewFaultAdminHandler(faults))
+	mux.Handle("/_admin/faults/", NewFaultAdminHandler(faults))
+	mux.Handle("/_admin/mirrors", NewMirrorStatsHandler(mirrors))
+	mux.Handle("/_admin/upgrades", NewUpgradeStatsHandler(upgrades))
+	mux.HandleFunc("/_ping", pingHandler)
+	server := &http.Server{Handler: mux}
+	go serve(server, ln)
+	log.WithFields(log.Fields{"address": config.AdminAddress}).Info("Serving admin API")
+	return server
+}
+
+// withProxyProtocol reads PROXY protocol headers on ln when it is turned on
+func withProxyProtocol(ln net.Listener) net.Listener {
+	if config.ProxyProtocol == "" {
+		return ln
+	}
+	trusted, err := ParseNetworks(config.ProxyProtocol)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid PROXY protocol sources")
+	}
+	return NewProxyProtocolListener(ln, trusted, proxyProtocolTimeout)
+}
+
+func serve(server *http.Server, ln net.Listener) {
+	err := server.Serve(ln)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// waitForSignals blocks until we are told to stop. SIGUSR2 hands our listeners
+// to a freshly exec'd conductor, which sends us SIGTERM once it is serving.
+// SIGHUP reloads TLS certificates from disk and reopens the access log.
+func waitForSignals(listeners *Listeners, servers []*http.Server, certWorker *CertificateFileWorker,
+	accessLog *AccessLog, upgrades *UpgradeTracker) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR2:
+			proc, err := listeners.Upgrade()
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Could not start upgraded conductor")
+				continue
+			}
+			log.WithFields(log.Fields{"pid": proc.Pid}).Info("Started upgraded conductor")
+			continue
+		case syscall.SIGHUP:
+			if certWorker != nil {
+				select {
+				case certWorker.ReloadChan <- true:
+				default:
+				}
+			}
+			if accessLog != nil {
+				if err := accessLog.Reopen(); err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Could not reopen access log")
+				}
+			}
+			continue
+		}
+
+		log.WithFields(log.Fields{"signal": sig, "drain_timeout": config.DrainTimeout,
+			"upgraded_connections": upgrades.Active()}).Info("Draining connections")
+		ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server *http.Server) {
+				defer wg.Done()
+				if err := server.Shutdown(ctx); err != nil {
+					log.WithFields(log.Fields{"error": err}).Warn("Timed out draining connections")
+				}
+			}(server)
+		}
+		wg.Wait()
+		// Hijacked connections aren't tracked by the servers
+		upgrades.Drain(ctx)
+		cancel()
+		return
+	}
+}
+
 func exit(lb *LoadBalancer, healthWorkers map[string]*ConsulHealthWorker) {
 	for mp, w := range lb.Workers {
 		log.WithFields(log.Fields{"mount_point": mp}).Debug("Telling loadbalancer worker to quit")
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// The version the mirror of a mount point is balanced as
+const MirrorVersion = "mirror"
+
+// Shadow requests carry this header so the shadow service can tell them apart
+const mirrorHeader = "X-Conductor-Mirror"
+
+// MirrorConfig copies a share of a mount point's requests to a shadow service
+// and throws its responses away, eg
+// {"service": "api-v2", "percent": 10, "max_body_size": "64KB"}
+type MirrorConfig struct {
+	// The Consul service to copy requests to. Defaults to the mirrored service.
+	Service string `json:"service"`
+	// Only nodes with this Consul tag get the copies. When the shadow is the
+	// same Consul service, the mirrored service leaves these nodes out.
+	Tag string `json:"tag"`
+	// Percentage of requests to copy, eg 10 or 0.5. Defaults to 100.
+	Percent float64 `json:"percent"`
+	// Requests with bigger bodies aren't copied. Defaults to 1MB.
+	MaxBodySize ByteSize `json:"max_body_size"`
+	// How long the shadow service gets to answer. Defaults to 10s.
+	Timeout Duration `json:"timeout"`
+	// Copies in flight at once. Past this requests aren't copied. Defaults to 100.
+	MaxInFlight int `json:"max_in_flight"`
+}
+
+func (c MirrorConfig) enabled() bool {
+	return c.Service != "" || c.Tag != ""
+}
+
+func (c MirrorConfig) withDefaults() MirrorConfig {
+	if c.Percent == 0 {
+		c.Percent = 100
+	}
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = 1 << 20
+	}
+	if c.Timeout.Duration == 0 {
+		c.Timeout.Duration = 10 * time.Second
+	}
+	if c.MaxInFlight == 0 {
+		c.MaxInFlight = 100
+	}
+	return c
+}
+
+// excludedTag returns the tag the mirrored service has to leave out, if the
+// shadow nodes are part of the same Consul service
+func (c MirrorConfig) excludedTag(service string) string {
+	if c.Tag != "" && (c.Service == "" || c.Service == service) {
+		return c.Tag
+	}
+	return ""
+}
+
+// MirrorService returns the service the copies of requests go to, or nil if
+// the service isn't mirrored
+func (s Service) MirrorService() *Service {
+	if !s.Mirror.enabled() {
+		return nil
+	}
+	name := s.Mirror.Service
+	if name == "" {
+		name = s.Name
+	}
+	return &Service{
+		Name:       name,
+		MountPoint: s.MountPoint,
+		Type:       s.Type,
+		Backend:    s.Backend,
+		Version:    MirrorVersion,
+		Tag:        s.Mirror.Tag,
+	}
+}
+
+// WithMirrors returns the list with a service added for every mirror
+func (list ServiceList) WithMirrors() *ServiceList {
+	all := append(ServiceList{}, list...)
+	for _, s := range list {
+		if mirror := s.MirrorService(); mirror != nil {
+			all = append(all, mirror)
+		}
+	}
+	return &all
+}
+
+// MirrorStats counts what happened to the copies sent to a shadow service
+type MirrorStats struct {
+	// Copies sent to the shadow service
+	Mirrored int64 `json:"mirrored"`
+	// Copies that failed or got a 5xx
+	Errors int64 `json:"errors"`
+	// Requests left out because of their body size or too many copies in flight
+	Skipped int64 `json:"skipped"`
+	// Copies that got an answer, by status code
+	Statuses map[int]int64 `json:"statuses"`
+	// Latency of the shadow service, in milliseconds
+	MeanLatency float64 `json:"mean_latency_ms"`
+	MaxLatency  float64 `json:"max_latency_ms"`
+
+	totalLatency time.Duration
+}
+
+// Mirror passes requests to the primary handler and, for a share of them,
+// sends a copy to the shadow service in the background. Clients only ever see
+// the primary response.
+type Mirror struct {
+	mu         sync.Mutex
+	mountPoint string
+	config     MirrorConfig
+	primary    http.Handler
+	shadow     http.Handler
+	inFlight   int
+	stats      MirrorStats
+	random     func() float64
+	// Called when a copy is done, for tests
+	done func()
+}
+
+// NewMirror copies requests for the service to shadow, which is normally the
+// reverse proxy for the service's MirrorService
+func NewMirror(s Service, shadow, primary http.Handler) *Mirror {
+	m := &Mirror{mountPoint: s.MountPoint, config: s.Mirror.withDefaults(), primary: primary,
+		shadow: shadow, random: rand.Float64, done: func() {}}
+	m.stats.Statuses = make(map[int]int64)
+	if rp, ok := shadow.(*httputil.ReverseProxy); ok {
+		// Shadow errors are counted, not sent anywhere or logged as ours
+		rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if mw, ok := w.(*mirrorWriter); ok {
+				mw.err = err
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+	return m
+}
+
+// Update takes the new percentage and limits from a changed service
+// definition. Pointing the mirror somewhere else needs a restart.
+func (m *Mirror) Update(s Service) {
+	config := s.Mirror.withDefaults()
+	m.mu.Lock()
+	m.config = config
+	m.mu.Unlock()
+	log.WithFields(log.Fields{"mount_point": m.mountPoint,
+		"percent": config.Percent}).Info("Updated traffic mirror")
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	config := m.config
+	sampled := m.random()*100 < config.Percent
+	m.mu.Unlock()
+	if !sampled || IsUpgradeRequest(r) || IsGRPCRequest(r) {
+		m.primary.ServeHTTP(w, r)
+		return
+	}
+
+	body, ok := bufferBody(r, int64(config.MaxBodySize))
+	if !ok || !m.acquire(config.MaxInFlight) {
+		m.mu.Lock()
+		m.stats.Skipped++
+		m.mu.Unlock()
+		m.primary.ServeHTTP(w, r)
+		return
+	}
+
+	// The copy outlives the client's request, so it only keeps its values
+	ctx, cancel := context.WithTimeout(detachContext(r.Context()), config.Timeout.Duration)
+	shadow := r.Clone(ctx)
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	shadow.Header.Set(mirrorHeader, "true")
+	go func() {
+		defer cancel()
+		m.send(shadow)
+	}()
+
+	m.primary.ServeHTTP(w, r)
+}
+
+// bufferBody reads the request body so it can be sent twice. Bodies over limit
+// are given back to the request untouched and not copied.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > limit {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (m *Mirror) acquire(max int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inFlight >= max {
+		return false
+	}
+	m.inFlight++
+	return true
+}
+
+func (m *Mirror) send(r *http.Request) {
+	defer m.done()
+	w := &mirrorWriter{discardWriter: newDiscardWriter()}
+	start := time.Now()
+	m.shadow.ServeHTTP(w, r)
+	latency := time.Since(start)
+
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	failed := w.err != nil || status >= http.StatusInternalServerError
+
+	m.mu.Lock()
+	m.inFlight--
+	m.stats.Mirrored++
+	if failed {
+		m.stats.Errors++
+	}
+	if w.err == nil {
+		m.stats.Statuses[status]++
+	}
+	m.stats.totalLatency += latency
+	if ms := float64(latency) / float64(time.Millisecond); ms > m.stats.MaxLatency {
+		m.stats.MaxLatency = ms
+	}
+	m.mu.Unlock()
+
+	fields := log.Fields{"mount_point": m.mountPoint, "url": r.URL.Path,
+		"status": status, "latency": latency}
+	if w.err != nil {
+		fields["error"] = w.err
+	}
+	if failed {
+		log.WithFields(fields).Warn("Mirrored request failed")
+	} else {
+		log.WithFields(fields).Debug("Mirrored request")
+	}
+}
+
+// Stats returns a snapshot of the mirror's counters
+func (m *Mirror) Stats() MirrorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	stats.Statuses = make(map[int]int64, len(m.stats.Statuses))
+	for status, count := range m.stats.Statuses {
+		stats.Statuses[status] = count
+	}
+	if stats.Mirrored > 0 {
+		stats.MeanLatency = float64(stats.totalLatency) / float64(stats.Mirrored) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+// mirrorWriter throws the shadow response away, keeping its status and any
+// error reaching the shadow service
+type mirrorWriter struct {
+	*discardWriter
+	status int
+	err    error
+}
+
+func (w *mirrorWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+}
+
+// NewMirrorStatsHandler serves the stats of every mirror by mount point
+func NewMirrorStatsHandler(mirrors map[string]*Mirror) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string]MirrorStats, len(mirrors))
+		for mp, m := range mirrors {
+			stats[mp] = m.Stats()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+}
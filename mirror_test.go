@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMirror(c MirrorConfig, shadow http.Handler) (*Mirror, chan struct{}) {
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("primary:" + string(body)))
+	})
+	m := NewMirror(Service{MountPoint: "/api", Mirror: c}, shadow, primary)
+	done := make(chan struct{}, 10)
+	m.done = func() { done <- struct{}{} }
+	return m, done
+}
+
+func waitForMirror(t *testing.T, done chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to be mirrored")
+	}
+}
+
+func TestMirrorService(t *testing.T) {
+	s := ParseServiceDefinition("api", []byte(`{"mirror": {"tag": "rewrite", "percent": 10}}`))
+	if len(s.ExcludeTags) != 1 || s.ExcludeTags[0] != "rewrite" {
+		t.Errorf("Expected the mirrored service to leave out shadow nodes but got %v", s.ExcludeTags)
+	}
+	shadow := s.MirrorService()
+	if shadow == nil || shadow.Name != "api" || shadow.Tag != "rewrite" || shadow.Key() != "/api@mirror" {
+		t.Errorf("Expected the shadow to be api nodes tagged rewrite but got %+v", shadow)
+	}
+
+	s = ParseServiceDefinition("api", []byte(`{"mirror": {"service": "api-v2", "tag": "rewrite"}}`))
+	if len(s.ExcludeTags) != 0 {
+		t.Errorf("Expected a shadow in another service to leave the nodes alone but got %v", s.ExcludeTags)
+	}
+	if ParseServiceDefinition("api", []byte(`{}`)).MirrorService() != nil {
+		t.Error("Expected no shadow service without a mirror")
+	}
+}
+
+func TestMirrorCopiesRequests(t *testing.T) {
+	copies := make(chan string, 1)
+	m, done := newTestMirror(MirrorConfig{Service: "api-v2"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		copies <- r.Method + " " + r.URL.Path + " " + string(body) + " " + r.Header.Get("X-Conductor-Mirror")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("shadow"))
+	}))
+
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"name":"bob"}`)))
+	if res.Body.String() != `primary:{"name":"bob"}` {
+		t.Errorf("Expected the client to only see the primary response but got '%s'", res.Body.String())
+	}
+	waitForMirror(t, done)
+	if copy := <-copies; copy != `POST /api/users {"name":"bob"} true` {
+		t.Errorf("Expected the shadow to get a copy of the request but got '%s'", copy)
+	}
+	if stats := m.Stats(); stats.Mirrored != 1 || stats.Errors != 0 || stats.Statuses[http.StatusCreated] != 1 {
+		t.Errorf("Expected one mirrored 201 but got %+v", stats)
+	}
+}
+
+func TestMirrorPercent(t *testing.T) {
+	m, done := newTestMirror(MirrorConfig{Service: "api-v2", Percent: 10}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.random = func() float64 { return 0.5 }
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users", nil))
+	m.random = func() float64 { return 0.05 }
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users", nil))
+	waitForMirror(t, done)
+	if stats := m.Stats(); stats.Mirrored != 1 {
+		t.Errorf("Expected only one request in ten to be mirrored but got %d", stats.Mirrored)
+	}
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	m, _ := newTestMirror(MirrorConfig{Service: "api-v2", MaxBodySize: 8}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected a large body not to be mirrored")
+	}))
+	body := strings.Repeat("x", 100)
+	r := httptest.NewRequest("POST", "/api/upload", strings.NewReader(body))
+	// Chunked, so the size is only found out by reading
+	r.ContentLength = -1
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, r)
+	if res.Body.String() != "primary:"+body {
+		t.Errorf("Expected the primary to get the whole body but got %d bytes", res.Body.Len())
+	}
+	if stats := m.Stats(); stats.Skipped != 1 || stats.Mirrored != 0 {
+		t.Errorf("Expected the request to be skipped but got %+v", stats)
+	}
+}
+
+func TestMirrorCountsShadowErrors(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	target, _ := url.Parse(down.URL)
+	down.Close()
+
+	m, done := newTestMirror(MirrorConfig{Service: "api-v2"}, httputil.NewSingleHostReverseProxy(target))
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if res.Code != http.StatusOK || res.Body.String() != "primary:" {
+		t.Errorf("Expected the client not to notice the shadow failing but got %d", res.Code)
+	}
+	waitForMirror(t, done)
+	if stats := m.Stats(); stats.Mirrored != 1 || stats.Errors != 1 || len(stats.Statuses) != 0 {
+		t.Errorf("Expected one failed copy but got %+v", stats)
+	}
+}
+
+func TestMirrorOutlivesClient(t *testing.T) {
+	release := make(chan struct{})
+	m, done := newTestMirror(MirrorConfig{Service: "api-v2"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if r.Context().Err() != nil {
+			t.Error("Expected the copy to carry on after the client is done")
+		}
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users", nil).WithContext(ctx))
+	cancel()
+	close(release)
+	waitForMirror(t, done)
+}
@@ -15,7 +15,7 @@ func NewNiaveRoundRobin(s Service) func() url.URL {
 			node := s.Nodes[i]
 			url := url.URL{
 				Host:   fmt.Sprintf("%s:%d", node.Address, node.Port),
-				Scheme: "http",
+				Scheme: s.SchemeFor(node),
 			}
 			return url
 		}
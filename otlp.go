@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SpanExporter sends finished spans to an OpenTelemetry collector in batches,
+// as OTLP/HTTP with JSON bodies
+type SpanExporter struct {
+	InputChan   chan *Span
+	ControlChan chan bool
+	done        chan bool
+	url         string
+	serviceName string
+	client      *http.Client
+	batchSize   int
+	interval    time.Duration
+}
+
+// NewSpanExporter sends spans to the collector at endpoint, eg
+// http://otel-collector:4318
+func NewSpanExporter(endpoint, serviceName string) *SpanExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &SpanExporter{
+		InputChan:   make(chan *Span, 2048),
+		ControlChan: make(chan bool, 1),
+		done:        make(chan bool),
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		batchSize:   512,
+		interval:    5 * time.Second,
+	}
+}
+
+// Export queues a span. Spans are dropped rather than holding up requests when
+// the collector can't keep up.
+func (e *SpanExporter) Export(s *Span) {
+	select {
+	case e.InputChan <- s:
+	default:
+		log.WithFields(log.Fields{"trace_id": s.Context.TraceIDString()}).Debug("Span queue full, dropping span")
+	}
+}
+
+func (e *SpanExporter) Work() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.InputChan:
+			batch = append(batch, s)
+			if len(batch) >= e.batchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		case _ = <-e.ControlChan:
+			for len(e.InputChan) > 0 {
+				batch = append(batch, <-e.InputChan)
+			}
+			e.send(batch)
+			close(e.done)
+			return
+		}
+	}
+}
+
+// Stop sends whatever spans are left and waits for the exporter to finish
+func (e *SpanExporter) Stop() {
+	e.ControlChan <- true
+	<-e.done
+}
+
+func (e *SpanExporter) send(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Could not encode spans")
+		return
+	}
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			err = fmt.Errorf("collector answered %d", res.StatusCode)
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "spans": len(spans),
+			"collector": e.url}).Warn("Could not export spans")
+	}
+}
+
+// The OTLP JSON encoding, trimmed to what we send
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue has one of its fields set. Integers are strings in OTLP JSON.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *SpanExporter) request(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.Context.TraceIDString(),
+			SpanID:            s.Context.SpanIDString(),
+			TraceState:        s.Context.TraceState,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: fmt.Sprint(s.Start.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprint(s.End.UnixNano()),
+			Attributes:        otlpAttributes(s.Attributes),
+			Status:            otlpStatus{Code: s.StatusCode, Message: s.StatusMessage},
+		}
+		if s.ParentSpanID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": e.serviceName})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "conductor", Version: Version}, Spans: encoded}},
+	}}}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	encoded := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value otlpValue
+		switch v := attributes[key].(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := fmt.Sprint(v)
+			value.IntValue = &s
+		case int64:
+			s := fmt.Sprint(v)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		encoded = append(encoded, otlpAttribute{Key: key, Value: value})
+	}
+	return encoded
+}
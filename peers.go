@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// Peers tracks how many conductor instances share global rate limits. Each
+// instance enforces its share of a global limit.
+type Peers struct {
+	mu          sync.Mutex
+	count       int
+	subscribers []func(int)
+}
+
+func NewPeers() *Peers {
+	return &Peers{count: 1}
+}
+
+// Count returns the number of healthy conductor instances, including us
+func (p *Peers) Count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count
+}
+
+// Subscribe calls f with the current count now and again whenever it changes
+func (p *Peers) Subscribe(f func(int)) {
+	p.mu.Lock()
+	p.subscribers = append(p.subscribers, f)
+	count := p.count
+	p.mu.Unlock()
+	f(count)
+}
+
+// SetCount updates the count and tells every subscriber about it
+func (p *Peers) SetCount(count int) {
+	if count < 1 {
+		// We're running even if Consul hasn't noticed yet
+		count = 1
+	}
+	p.mu.Lock()
+	if count == p.count {
+		p.mu.Unlock()
+		return
+	}
+	p.count = count
+	subscribers := append([]func(int){}, p.subscribers...)
+	p.mu.Unlock()
+
+	log.WithFields(log.Fields{"peers": count}).Info("Conductor peer count changed, rebalancing global rate limits")
+	for _, f := range subscribers {
+		f(count)
+	}
+}
+
+// ConsulPeerWorker registers this conductor in Consul under a shared service
+// name with a TTL check, keeps the check passing and watches how many healthy
+// instances there are.
+type ConsulPeerWorker struct {
+	ControlChan  chan bool
+	InputChan    chan []*api.ServiceEntry
+	consul       *Consul
+	peers        *Peers
+	serviceName  string
+	serviceID    string
+	port         int
+	ttl          time.Duration
+	queryOptions *api.QueryOptions
+	lastIndex    uint64
+	done         chan struct{}
+}
+
+// NewConsulPeerWorker registers under an ID with our pid in it, so the process
+// we hand over to on upgrade doesn't share, and lose, our registration
+func NewConsulPeerWorker(c *Consul, peers *Peers, serviceName string, port int) *ConsulPeerWorker {
+	hostname, _ := os.Hostname()
+	return &ConsulPeerWorker{
+		ControlChan:  make(chan bool, 1),
+		InputChan:    make(chan []*api.ServiceEntry, 1),
+		consul:       c,
+		peers:        peers,
+		serviceName:  serviceName,
+		serviceID:    fmt.Sprintf("%s-%s-%d-%d", serviceName, hostname, port, os.Getpid()),
+		port:         port,
+		ttl:          time.Duration(30) * time.Second,
+		queryOptions: &api.QueryOptions{WaitTime: time.Duration(30) * time.Second, RequireConsistent: true},
+		done:         make(chan struct{}),
+	}
+}
+
+func (w *ConsulPeerWorker) checkID() string {
+	return fmt.Sprintf("service:%s", w.serviceID)
+}
+
+// Register adds us to the local Consul agent and marks us healthy
+func (w *ConsulPeerWorker) Register() error {
+	registration := &api.AgentServiceRegistration{
+		ID:   w.serviceID,
+		Name: w.serviceName,
+		Port: w.port,
+		Check: &api.AgentServiceCheck{
+			TTL:                            w.ttl.String(),
+			DeregisterCriticalServiceAfter: (10 * w.ttl).String(),
+		},
+	}
+	if err := w.consul.Client.Agent().ServiceRegister(registration); err != nil {
+		return err
+	}
+	return w.consul.Client.Agent().PassTTL(w.checkID(), "")
+}
+
+// Deregister removes us from Consul so the others pick up our share
+func (w *ConsulPeerWorker) Deregister() error {
+	return w.consul.Client.Agent().ServiceDeregister(w.serviceID)
+}
+
+// Stop tells Work to deregister us and waits for it, so we have left Consul
+// before the process exits. An agent that doesn't answer only holds us up
+// for timeout.
+func (w *ConsulPeerWorker) Stop(timeout time.Duration) {
+	w.ControlChan <- true
+	select {
+	case <-w.done:
+	case <-time.After(timeout):
+		log.WithFields(log.Fields{
+			"service_id":  w.serviceID,
+			"worker_type": "consul_peers"}).Warn("Gave up waiting to deregister from consul")
+	}
+}
+
+func (w *ConsulPeerWorker) Work() {
+	defer close(w.done)
+	heartbeat := time.NewTicker(w.ttl / 3)
+	defer heartbeat.Stop()
+	go w.BlockUntilConsulUpdate()
+	for {
+		select {
+		case result := <-w.InputChan:
+			if result != nil {
+				w.peers.SetCount(len(result))
+			}
+			go w.BlockUntilConsulUpdate()
+		case <-heartbeat.C:
+			if err := w.consul.Client.Agent().PassTTL(w.checkID(), ""); err != nil {
+				log.WithFields(log.Fields{
+					"service_id":  w.serviceID,
+					"error":       err,
+					"worker_type": "consul_peers"}).Warn("Could not update peer health check, registering again")
+				// The agent may have lost or removed our registration
+				if err := w.Register(); err != nil {
+					log.WithFields(log.Fields{
+						"service_id":  w.serviceID,
+						"error":       err,
+						"worker_type": "consul_peers"}).Error("Could not register with consul")
+				}
+			}
+		case _ = <-w.ControlChan:
+			if err := w.Deregister(); err != nil {
+				log.WithFields(log.Fields{
+					"service_id":  w.serviceID,
+					"error":       err,
+					"worker_type": "consul_peers"}).Error("Could not deregister from consul")
+			}
+			return
+		}
+	}
+}
+
+func (w *ConsulPeerWorker) BlockUntilConsulUpdate() {
+	services, queryMeta, err := w.consul.Client.Health().Service(w.serviceName, "", true, w.queryOptions)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"service_name": w.serviceName,
+			"error":        err,
+			"last_index":   w.lastIndex,
+			"worker_type":  "consul_peers"}).Error("Error getting conductor peers from consul")
+		time.Sleep(time.Duration(7) * time.Second)
+		w.InputChan <- nil
+		return
+	}
+
+	if queryMeta.LastIndex == w.lastIndex {
+		w.InputChan <- nil
+		return
+	}
+	if queryMeta.LastIndex < w.lastIndex {
+		// Consul's state was reset, eg restored from a snapshot, so start over
+		// rather than wait for an index that may never come
+		w.lastIndex = 0
+		w.queryOptions.WaitIndex = 0
+		w.InputChan <- nil
+		return
+	}
+	w.lastIndex = queryMeta.LastIndex
+	w.queryOptions.WaitIndex = queryMeta.LastIndex
+	w.InputChan <- services
+}
+
+// UsesGlobalRateLimits checks whether any service needs to know about peers
+func UsesGlobalRateLimits(services ServiceList) bool {
+	for _, s := range services {
+		for _, c := range s.RateLimits {
+			if c.Global {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeersSubscribe(t *testing.T) {
+	peers := NewPeers()
+	var seen []int
+	peers.Subscribe(func(count int) { seen = append(seen, count) })
+
+	peers.SetCount(3)
+	peers.SetCount(3)
+	peers.SetCount(0)
+
+	expected := []int{1, 3, 1}
+	if fmt.Sprint(seen) != fmt.Sprint(expected) {
+		t.Errorf("Expected subscriber to see %v but got %v", expected, seen)
+	}
+}
+
+func TestGlobalRateLimitIsShared(t *testing.T) {
+	peers := NewPeers()
+	peers.SetCount(4)
+
+	s := Service{Name: "api", MountPoint: "/api",
+		RateLimits: []RateLimitConfig{{Requests: 8, Per: Duration{time.Minute}, Key: "service", Global: true}}}
+	handler := NewRateLimitHandler(s, peers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	allowed := func() int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+			if res.Code == http.StatusNoContent {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := allowed(); n != 2 {
+		t.Errorf("Expected a quarter of the burst of 8 with 4 peers but got %d", n)
+	}
+}
+
+func TestUsesGlobalRateLimits(t *testing.T) {
+	services := ServiceList{
+		&Service{Name: "solr", MountPoint: "/solr"},
+		&Service{Name: "api", MountPoint: "/api", RateLimits: []RateLimitConfig{{Requests: 1}}},
+	}
+	if UsesGlobalRateLimits(services) {
+		t.Error("Expected no global rate limits")
+	}
+	services[1].RateLimits[0].Global = true
+	if !UsesGlobalRateLimits(services) {
+		t.Error("Expected global rate limits to be found")
+	}
+}
+
+// fakeConsul answers just enough of the Consul HTTP API for the peer worker
+type fakeConsul struct {
+	mu         sync.Mutex
+	index      uint64
+	peers      int
+	registered map[string]bool
+	passes     int
+	kv         map[string][]byte
+	// The index each health query waited on, "" when it didn't
+	waited map[string]bool
+}
+
+func (f *fakeConsul) setKV(key string, value []byte) {
+	f.mu.Lock()
+	f.kv[key] = value
+	f.index++
+	f.mu.Unlock()
+}
+
+func (f *fakeConsul) setPeers(n int) {
+	f.mu.Lock()
+	f.peers = n
+	f.index++
+	f.mu.Unlock()
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		var registration api.AgentServiceRegistration
+		json.NewDecoder(r.Body).Decode(&registration)
+		f.registered[registration.ID] = true
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		delete(f.registered, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/pass/service:"):
+		if !f.registered[strings.TrimPrefix(r.URL.Path, "/v1/agent/check/pass/service:")] {
+			http.Error(w, "Unknown check", http.StatusInternalServerError)
+			return
+		}
+		f.passes++
+	case r.URL.Path == "/v1/health/service/conductor":
+		if f.waited != nil {
+			f.waited[r.URL.Query().Get("index")] = true
+		}
+		entries := make([]*api.ServiceEntry, f.peers)
+		for i := range entries {
+			entries[i] = &api.ServiceEntry{
+				Node:    &api.Node{Node: fmt.Sprintf("conductor%d", i)},
+				Service: &api.AgentService{Service: "conductor", Port: 8888},
+			}
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(f.index))
+		json.NewEncoder(w).Encode(entries)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		w.Header().Set("X-Consul-Index", fmt.Sprint(f.index))
+		value, ok := f.kv[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(api.KVPairs{{Key: key, Value: value, ModifyIndex: f.index}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestConsulPeerWorker(t *testing.T) {
+	fake := &fakeConsul{index: 1, peers: 1, registered: make(map[string]bool)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	c, err := NewConsul(strings.TrimPrefix(ts.URL, "http://"), "dc1", "conductor/services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := NewPeers()
+	w := NewConsulPeerWorker(c, peers, "conductor", 8888)
+	w.queryOptions.WaitTime = 10 * time.Millisecond
+
+	if err := w.Register(); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.registered[w.serviceID] || fake.passes != 1 {
+		t.Errorf("Expected to be registered with a passing check but got %v and %d passes", fake.registered, fake.passes)
+	}
+
+	go w.Work()
+	fake.setPeers(3)
+	waitFor(t, func() bool { return peers.Count() == 3 })
+
+	fake.setPeers(2)
+	waitFor(t, func() bool { return peers.Count() == 2 })
+
+	// Consul restored from a snapshot goes back to an older index
+	fake.mu.Lock()
+	fake.index = 1
+	fake.peers = 4
+	fake.waited = make(map[string]bool)
+	fake.mu.Unlock()
+	waitFor(t, func() bool { return peers.Count() == 4 })
+	waitFor(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.waited[""]
+	})
+
+	w.Stop(time.Second)
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.registered[w.serviceID] {
+		t.Error("Expected to be deregistered by the time Stop returns")
+	}
+}
+
+func TestConsulPeerWorkerHandover(t *testing.T) {
+	fake := &fakeConsul{index: 1, peers: 1, registered: make(map[string]bool)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	c, err := NewConsul(strings.TrimPrefix(ts.URL, "http://"), "dc1", "conductor/services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := func(id string) bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.registered[id]
+	}
+
+	parent := NewConsulPeerWorker(c, NewPeers(), "conductor", 8888)
+	parent.queryOptions.WaitTime = 10 * time.Millisecond
+	// The process we upgrade to has a pid of its own
+	child := NewConsulPeerWorker(c, NewPeers(), "conductor", 8888)
+	child.serviceID += "-child"
+	child.queryOptions.WaitTime = 10 * time.Millisecond
+	child.ttl = 30 * time.Millisecond
+	for _, w := range []*ConsulPeerWorker{parent, child} {
+		if err := w.Register(); err != nil {
+			t.Fatal(err)
+		}
+		go w.Work()
+	}
+
+	parent.Stop(time.Second)
+	if registered(parent.serviceID) {
+		t.Error("Expected the parent to be deregistered")
+	}
+	if !registered(child.serviceID) {
+		t.Error("Expected the parent to leave the child's registration alone")
+	}
+
+	// A registration lost some other way comes back with the next heartbeat
+	fake.mu.Lock()
+	delete(fake.registered, child.serviceID)
+	fake.mu.Unlock()
+	waitFor(t, func() bool { return registered(child.serviceID) })
+	child.Stop(time.Second)
+}
@@ -1,14 +1,43 @@
 package main
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"fmt"
+	log "github.com/sirupsen/logrus"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 )
 
-func NewReverseProxyWithLoadBalancer(mountPoint string, requests chan *chan url.URL) *httputil.ReverseProxy {
+// Pattern returns the http.ServeMux pattern for the service. Normal services
+// match everything under the mount point, gRPC services match a whole gRPC
+// service or a single method.
+func (s Service) Pattern() string {
+	if s.Type == ServiceTypeGRPC && strings.Count(s.MountPoint, "/") > 1 {
+		return s.MountPoint
+	}
+	return fmt.Sprintf("%s/", s.MountPoint)
+}
+
+// StrippedPrefix returns the part of the path RewritePath takes off
+func (s Service) StrippedPrefix() string {
+	if s.Type == ServiceTypeGRPC {
+		return ""
+	}
+	return s.MountPoint
+}
+
+// RewritePath returns the path to send to the backend. The mount point is
+// stripped except for gRPC, where the path is the method name.
+func (s Service) RewritePath(path string) string {
+	if s.Type == ServiceTypeGRPC {
+		return path
+	}
+	return strings.TrimPrefix(path, s.MountPoint)
+}
+
+func NewReverseProxyWithLoadBalancer(s Service, requests chan *chan url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+	mountPoint := s.MountPoint
 	response := make(chan url.URL, 1)
 	director := func(req *http.Request) {
 		// send our channel to the worker
@@ -16,10 +45,14 @@ func NewReverseProxyWithLoadBalancer(mountPoint string, requests chan *chan url.
 		// Get the server URL as the response back on the channel
 		server := <-response
 
-		req.URL.Scheme = "http"
+		req.URL.Scheme = server.Scheme
+		if req.URL.Scheme == "" {
+			req.URL.Scheme = "http"
+		}
 		req.URL.Host = server.Host
 		originalRequest := req.URL.Path
-		req.URL.Path = strings.TrimPrefix(req.URL.Path, mountPoint)
+		req.URL.Path = s.RewritePath(req.URL.Path)
+		setForwardedHeaders(req, s.StrippedPrefix())
 
 		if server.Host == "" {
 			log.WithFields(log.Fields{
@@ -35,8 +68,35 @@ func NewReverseProxyWithLoadBalancer(mountPoint string, requests chan *chan url.
 			"rewritten_request": req.URL.Path,
 			"mount_point":       mountPoint,
 			"forward_to":        req.URL.Host,
-		}).Info("Proxying request")
+		}).Debug("Proxying request")
+		if entry := accessLogEntryFrom(req); entry != nil {
+			entry.proxying(mountPoint, req)
+		}
 	}
 
-	return &httputil.ReverseProxy{Director: director}
+	modifyResponse := func(res *http.Response) error {
+		if entry := accessLogEntryFrom(res.Request); entry != nil {
+			entry.proxied(res)
+		}
+		return nil
+	}
+
+	errorHandler := func(w http.ResponseWriter, req *http.Request, err error) {
+		if req.URL.Host == "" {
+			err = NewNoHealthyNodesError(s.Name, req.URL.Path)
+		}
+		proxyErrorHandler(w, req, err)
+	}
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	transport = &tracingTransport{RoundTripper: transport, mountPoint: mountPoint}
+	rp := &httputil.ReverseProxy{Director: director, Transport: transport, ErrorHandler: errorHandler,
+		ModifyResponse: modifyResponse}
+	if s.Type == ServiceTypeGRPC {
+		// Stream every message through as soon as it arrives
+		rp.FlushInterval = -1
+	}
+	return rp
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a trusted load balancer has to send its PROXY protocol header
+const proxyProtocolTimeout = 5 * time.Second
+
+// Nodes tagged for PROXY protocol get URLs with this in front of their scheme,
+// which NewBackendTransport routes to a ProxyProtocolTransport
+const proxyProtocolSchemePrefix = "proxy+"
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolListener reads the PROXY protocol header, version 1 or 2, that
+// TCP load balancers put in front of a connection, and uses the client address
+// from it as the connection's remote address. Only trusted sources may send
+// one. They may also leave it out, eg for health checks.
+type ProxyProtocolListener struct {
+	net.Listener
+	trusted Networks
+	timeout time.Duration
+}
+
+func NewProxyProtocolListener(ln net.Listener, trusted Networks, timeout time.Duration) *ProxyProtocolListener {
+	return &ProxyProtocolListener{Listener: ln, trusted: trusted, timeout: timeout}
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !l.trusted.Contains(host) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+// proxyProtocolConn reads the header on first use rather than in Accept, so a
+// slow load balancer can't hold up other connections
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	source  net.Addr
+	err     error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.source, c.err = readProxyProtocolHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil && c.err != io.EOF {
+			log.WithFields(log.Fields{"remote_address": c.Conn.RemoteAddr().String(),
+				"error": c.err}).Warn("Invalid PROXY protocol header")
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader returns the client address from a PROXY protocol
+// header, or nil if there is no header or it doesn't name a TCP client
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if prefix, _ := r.Peek(6); string(prefix) == "PROXY " {
+			return readProxyProtocolV1(r)
+		}
+	case '\r':
+		if prefix, _ := r.Peek(len(proxyProtocolV2Signature)); bytes.Equal(prefix, proxyProtocolV2Signature) {
+			return readProxyProtocolV2(r)
+		}
+	}
+	return nil, nil
+}
+
+// readProxyProtocolV1 reads the text form, eg
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		// The longest valid header is 107 bytes
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("PROXY protocol v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY protocol v1 header not ended by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header '%s'", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 source '%s %s'", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyProtocolV2 reads the binary form
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x0:
+		// LOCAL, the load balancer talking for itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol v2 command %d", header[12]&0x0f)
+	}
+	switch header[13] >> 4 {
+	case 0x1:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("short PROXY protocol v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("short PROXY protocol v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// Unix sockets and unspecified families carry no address we can use
+	return nil, nil
+}
+
+// proxyProtocolHeader formats the header for a connection from source to
+// destination. Without both addresses it says the connection is unknown.
+func proxyProtocolHeader(version int, source, destination *net.TCPAddr) []byte {
+	known := source != nil && destination != nil
+	ipv4 := known && source.IP.To4() != nil && destination.IP.To4() != nil
+	if version == 2 {
+		return proxyProtocolV2Header(known, ipv4, source, destination)
+	}
+	switch {
+	case !known:
+		return []byte("PROXY UNKNOWN\r\n")
+	case ipv4:
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n",
+			source.IP.To4(), destination.IP.To4(), source.Port, destination.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n",
+		source.IP.To16(), destination.IP.To16(), source.Port, destination.Port))
+}
+
+func proxyProtocolV2Header(known, ipv4 bool, source, destination *net.TCPAddr) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	var addresses []byte
+	switch {
+	case !known:
+		header = append(header, 0x20, 0x00)
+	case ipv4:
+		header = append(header, 0x21, 0x11)
+		addresses = append(append(addresses, source.IP.To4()...), destination.IP.To4()...)
+	default:
+		header = append(header, 0x21, 0x21)
+		addresses = append(append(addresses, source.IP.To16()...), destination.IP.To16()...)
+	}
+	if known {
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(source.Port))
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(destination.Port))
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+// ProxyProtocolTransport sends requests for proxy+ URLs to nodes on a new
+// connection that starts with a PROXY protocol header naming the client
+type ProxyProtocolTransport struct {
+	transport *http.Transport
+	h2c       *H2CTransport
+}
+
+func NewProxyProtocolTransport(base *http.Transport, version int) *ProxyProtocolTransport {
+	dial := proxyProtocolDialer(version)
+	// A header speaks for one client, so connections can't be reused
+	transport := base.Clone()
+	transport.DisableKeepAlives = true
+	transport.DialContext = dial
+	h2c := NewH2CTransport()
+	h2c.transport.DisableKeepAlives = true
+	h2c.transport.DialContext = dial
+	return &ProxyProtocolTransport{transport: transport, h2c: h2c}
+}
+
+type proxyProtocolKey struct{}
+
+// proxyProtocolAddresses are the client and the address it connected to
+type proxyProtocolAddresses struct {
+	source, destination *net.TCPAddr
+}
+
+func (t *ProxyProtocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := context.WithValue(req.Context(), proxyProtocolKey{}, proxyProtocolAddressesFor(req))
+	out := req.Clone(ctx)
+	out.URL.Scheme = strings.TrimPrefix(out.URL.Scheme, proxyProtocolSchemePrefix)
+	if out.URL.Scheme == "h2c" {
+		return t.h2c.RoundTrip(out)
+	}
+	return t.transport.RoundTrip(out)
+}
+
+// proxyProtocolAddressesFor names the client behind any trusted proxies. Its
+// port is only known when it connected to us itself.
+func proxyProtocolAddressesFor(req *http.Request) proxyProtocolAddresses {
+	var addresses proxyProtocolAddresses
+	peer, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return addresses
+	}
+	client := clientIP(req)
+	if client != peer {
+		port = "0"
+	}
+	addresses.source = tcpAddr(client, port)
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, port, err := net.SplitHostPort(local.String()); err == nil {
+			addresses.destination = tcpAddr(host, port)
+		}
+	}
+	return addresses
+}
+
+func tcpAddr(host, port string) *net.TCPAddr {
+	ip := net.ParseIP(host)
+	portNumber, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: portNumber}
+}
+
+func proxyProtocolDialer(version int) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		addresses, _ := ctx.Value(proxyProtocolKey{}).(proxyProtocolAddresses)
+		if _, err := conn.Write(proxyProtocolHeader(version, addresses.source, addresses.destination)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newProxyProtocolServer serves the remote address of each request from a
+// listener that trusts the given sources
+func newProxyProtocolServer(t *testing.T, trusted string) *httptest.Server {
+	networks, err := ParseNetworks(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+	ts.Listener = NewProxyProtocolListener(ts.Listener, networks, time.Second)
+	ts.Start()
+	return ts
+}
+
+// sendWithHeader sends a GET after the raw header and returns the status line
+// and body
+func sendWithHeader(t *testing.T, ts *httptest.Server, header []byte) (string, string) {
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(header)
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var body strings.Builder
+	bufio.NewReader(res.Body).WriteTo(&body)
+	return res.Status, body.String()
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ts := newProxyProtocolServer(t, "127.0.0.1")
+	defer ts.Close()
+
+	tests := map[string]struct {
+		header   []byte
+		expected string
+	}{
+		"v1 IPv4": {[]byte("PROXY TCP4 203.0.113.9 192.0.2.1 4242 80\r\n"), "203.0.113.9:4242"},
+		"v1 IPv6": {[]byte("PROXY TCP6 2001:db8::9 2001:db8::1 4242 80\r\n"), "[2001:db8::9]:4242"},
+		"v2 IPv4": {proxyProtocolHeader(2, &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 4242},
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}), "203.0.113.9:4242"},
+		"v2 IPv6": {proxyProtocolHeader(2, &net.TCPAddr{IP: net.ParseIP("2001:db8::9"), Port: 4242},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}), "[2001:db8::9]:4242"},
+	}
+	for name, test := range tests {
+		status, body := sendWithHeader(t, ts, test.header)
+		if body != test.expected {
+			t.Errorf("%s: expected the remote address to be %s but got %s (%s)", name, test.expected, body, status)
+		}
+	}
+
+	// Load balancers' own connections keep the real address
+	for name, header := range map[string][]byte{
+		"none":       nil,
+		"v1 UNKNOWN": proxyProtocolHeader(1, nil, nil),
+		"v2 LOCAL":   proxyProtocolHeader(2, nil, nil),
+	} {
+		if _, body := sendWithHeader(t, ts, header); !strings.HasPrefix(body, "127.0.0.1:") {
+			t.Errorf("%s: expected the real remote address but got %s", name, body)
+		}
+	}
+}
+
+func TestProxyProtocolListenerUntrusted(t *testing.T) {
+	ts := newProxyProtocolServer(t, "10.0.0.0/8")
+	defer ts.Close()
+
+	status, body := sendWithHeader(t, ts, []byte("PROXY TCP4 203.0.113.9 192.0.2.1 4242 80\r\n"))
+	if !strings.HasPrefix(status, "400") || strings.Contains(body, "203.0.113.9") {
+		t.Errorf("Expected a header from an untrusted source to be refused but got %s %s", status, body)
+	}
+	if _, body := sendWithHeader(t, ts, nil); !strings.HasPrefix(body, "127.0.0.1:") {
+		t.Errorf("Expected the real remote address but got %s", body)
+	}
+}
+
+func TestProxyProtocolMalformed(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 not-an-ip 192.0.2.1 4242 80\r\n"))
+	if _, err := readProxyProtocolHeader(r); err == nil {
+		t.Error("Expected a malformed v1 header to be refused")
+	}
+	r = bufio.NewReader(strings.NewReader("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"))
+	if _, err := readProxyProtocolHeader(r); err == nil {
+		t.Error("Expected an overlong v1 header to be refused")
+	}
+}
+
+func TestProxyToProxyProtocolBackend(t *testing.T) {
+	backend := newProxyProtocolServer(t, "127.0.0.1")
+	defer backend.Close()
+	s := serviceForTestServer("users", "/api", backend)
+	s.Backend.ProxyProtocolVersion = 2
+	s.Nodes[0].Tags = []string{DefaultBackendProxyProtocolTag}
+	if s.SchemeFor(s.Nodes[0]) != "proxy+http" {
+		t.Fatalf("Expected a tagged node to use proxy+http but got '%s'", s.SchemeFor(s.Nodes[0]))
+	}
+	proxy, stop := newTestProxy(t, s)
+	defer stop()
+
+	// Each client gets its own connection with its own header
+	for _, client := range []string{"203.0.113.9:4242", "198.51.100.7:5151"} {
+		r := httptest.NewRequest("GET", "/api/users", nil)
+		r.RemoteAddr = client
+		local := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+		res := httptest.NewRecorder()
+		proxy.ServeHTTP(res, r)
+		if res.Body.String() != client {
+			t.Errorf("Expected the node to see %s but got '%s'", client, res.Body.String())
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig is one rate limit in a service definition, eg
+// {"requests": 100, "per": "1m", "burst": 20, "key": "header:X-Api-Key"}
+type RateLimitConfig struct {
+	// How many requests are allowed every Per
+	Requests float64 `json:"requests"`
+	// Defaults to one second
+	Per Duration `json:"per"`
+	// How many requests can arrive at once. Defaults to Requests.
+	Burst float64 `json:"burst"`
+	// What each bucket is for: "ip" (the default), "header:<name>", "route"
+	// (method and path) or "service" (one bucket for the whole mount point)
+	Key string `json:"key"`
+	// Share the limit across every conductor instance rather than applying it
+	// to each one. Each instance enforces its share of the rate and burst.
+	Global bool `json:"global"`
+}
+
+// RatePerSecond returns the sustained rate in requests a second
+func (c RateLimitConfig) RatePerSecond() float64 {
+	per := c.Per.Duration
+	if per == 0 {
+		per = time.Second
+	}
+	return c.Requests / per.Seconds()
+}
+
+// BurstSize returns how many requests a full bucket holds
+func (c RateLimitConfig) BurstSize() float64 {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	return math.Max(c.Requests, 1)
+}
+
+// KeyFor returns the bucket a request belongs to. Requests without the header
+// being limited on share a single bucket.
+func (c RateLimitConfig) KeyFor(r *http.Request) string {
+	switch {
+	case c.Key == "" || c.Key == "ip":
+		return clientIP(r)
+	case strings.HasPrefix(c.Key, "header:"):
+		return r.Header.Get(strings.TrimPrefix(c.Key, "header:"))
+	case c.Key == "route":
+		return r.Method + " " + r.URL.Path
+	}
+	return ""
+}
+
+// TokenBucket refills at rate tokens a second up to burst tokens. Each request
+// takes one token.
+type TokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if there is one. Otherwise it returns how long until
+// the next token arrives.
+func (b *TokenBucket) take(now time.Time, rate, burst float64) (bool, time.Duration) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if rate <= 0 {
+		return false, time.Hour
+	}
+	wait := (1 - b.tokens) / rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// RateLimiter keeps a token bucket for every key seen. Buckets that have filled
+// back up are thrown away every so often so memory doesn't grow forever.
+type RateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*TokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewRateLimiter(rate, burst float64) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*TokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &TokenBucket{}
+		l.buckets[key] = bucket
+	}
+	return bucket.take(now, l.rate, l.burst)
+}
+
+// SetRate changes the rate and burst for every bucket
+func (l *RateLimiter) SetRate(rate, burst float64) {
+	l.mu.Lock()
+	l.rate = rate
+	l.burst = burst
+	l.mu.Unlock()
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	if l.rate <= 0 {
+		return
+	}
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// NewRateLimitHandler enforces every rate limit in the service definition
+// before handing the request on. Global limits are split between peers.
+func NewRateLimitHandler(s Service, peers *Peers, handler http.Handler) http.Handler {
+	if len(s.RateLimits) == 0 {
+		return handler
+	}
+	limiters := make([]*RateLimiter, len(s.RateLimits))
+	for i, c := range s.RateLimits {
+		limiters[i] = NewRateLimiter(c.RatePerSecond(), c.BurstSize())
+		if c.Global && peers != nil {
+			limiter, rate, burst := limiters[i], c.RatePerSecond(), c.BurstSize()
+			peers.Subscribe(func(count int) {
+				limiter.SetRate(rate/float64(count), math.Max(burst/float64(count), 1))
+			})
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, c := range s.RateLimits {
+			if ok, retryAfter := limiters[i].Allow(c.KeyFor(r)); !ok {
+				rateLimited(w, r, c, retryAfter)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
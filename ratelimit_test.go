@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("10.0.0.1"); !ok {
+			t.Fatalf("Expected request %d to fit in the burst", i+1)
+		}
+	}
+
+	ok, retryAfter := l.Allow("10.0.0.1")
+	if ok {
+		t.Fatal("Expected the fourth request to be limited")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected to retry after 500ms but got %s", retryAfter)
+	}
+
+	if ok, _ := l.Allow("10.0.0.2"); !ok {
+		t.Error("Expected another key to have its own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("10.0.0.1"); !ok {
+		t.Error("Expected a token to be back after 500ms")
+	}
+}
+
+func TestRateLimiterSweepsFullBuckets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(1, 1)
+	l.now = func() time.Time { return now }
+	l.Allow("10.0.0.1")
+
+	now = now.Add(2 * time.Minute)
+	l.Allow("10.0.0.2")
+	if _, ok := l.buckets["10.0.0.1"]; ok {
+		t.Error("Expected the idle bucket to be swept")
+	}
+}
+
+func TestRateLimitConfigKeyFor(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	r.RemoteAddr = "192.168.1.10:51234"
+	r.Header.Set("X-Api-Key", "abc123")
+
+	tests := map[string]string{
+		"":                 "192.168.1.10",
+		"ip":               "192.168.1.10",
+		"header:X-Api-Key": "abc123",
+		"route":            "GET /api/users",
+		"service":          "",
+	}
+	for key, expected := range tests {
+		if result := (RateLimitConfig{Key: key}).KeyFor(r); result != expected {
+			t.Errorf("Expected key '%s' to give '%s' but got '%s'", key, expected, result)
+		}
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	s := Service{Name: "api", MountPoint: "/api",
+		RateLimits: []RateLimitConfig{{Requests: 1, Per: Duration{time.Minute}, Key: "header:X-Api-Key"}}}
+	handler := NewRateLimitHandler(s, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/users", nil)
+		r.Header.Set("X-Api-Key", key)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, r)
+		return res
+	}
+
+	if res := request("one"); res.Code != http.StatusNoContent {
+		t.Fatalf("Expected the first request to be proxied but got %d", res.Code)
+	}
+
+	res := request("one")
+	if res.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected a 429 but got %d", res.Code)
+	}
+	if res.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected Retry-After: 60 but got '%s'", res.Header().Get("Retry-After"))
+	}
+	expected := `{"error":"rate_limited","message":"Too many requests for '/api/users', retry after 60 seconds"}` + "\n"
+	if res.Body.String() != expected {
+		t.Errorf("Expected body '%s' but got '%s'", expected, res.Body.String())
+	}
+
+	if res := request("two"); res.Code != http.StatusNoContent {
+		t.Errorf("Expected a different API key to be proxied but got %d", res.Code)
+	}
+}
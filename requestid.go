@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the request's ID, or "" if it doesn't have one
+func requestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDs gives every request an ID, keeping the one the client sent if it
+// looks sane. The ID goes to the node and back to the client in header, and
+// into conductor's logs and error bodies, so they can all be matched up.
+type RequestIDs struct {
+	header string
+}
+
+func NewRequestIDs(header string) *RequestIDs {
+	return &RequestIDs{header: http.CanonicalHeaderKey(header)}
+}
+
+func (ids *RequestIDs) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(ids.header)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(ids.header, id)
+		}
+		w.Header().Set(ids.header, id)
+		rw := &requestIDWriter{ResponseWriter: w, header: ids.header, id: id}
+		handler.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		if !rw.wroteHeader {
+			// Nothing was written, so the headers go out once we return
+			w.Header().Set(ids.header, id)
+		}
+	})
+}
+
+// validRequestID accepts IDs that are safe to put in logs and JSON as they are
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '+' || c == '/' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random version 4 UUID
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestIDWriter puts the ID back in the response headers in case the node
+// sent one too, so the client only gets ours
+type requestIDWriter struct {
+	http.ResponseWriter
+	header      string
+	id          string
+	wroteHeader bool
+}
+
+func (w *requestIDWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.Header().Set(w.header, w.id)
+		w.wroteHeader = status >= http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *requestIDWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *requestIDWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *requestIDWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestIDGenerated(t *testing.T) {
+	var sent string
+	handler := NewRequestIDs("X-Request-Id").Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get("X-Request-Id")
+		if requestIDFrom(r) != sent {
+			t.Errorf("Expected the ID to be in the context but got '%s'", requestIDFrom(r))
+		}
+	}))
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/users", nil))
+	if !uuidPattern.MatchString(sent) {
+		t.Errorf("Expected a UUID to be passed on but got '%s'", sent)
+	}
+	if res.Header().Get("X-Request-Id") != sent {
+		t.Errorf("Expected the client to get '%s' back but got '%s'", sent, res.Header().Get("X-Request-Id"))
+	}
+}
+
+func TestRequestIDFromClient(t *testing.T) {
+	handler := NewRequestIDs("X-Correlation-Id").Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Nodes often echo the ID, which mustn't give the client two of them
+		w.Header().Add("X-Correlation-Id", r.Header.Get("X-Correlation-Id"))
+	}))
+
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	r.Header.Set("X-Correlation-Id", "client-1234")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+	if ids := res.Header().Values("X-Correlation-Id"); len(ids) != 1 || ids[0] != "client-1234" {
+		t.Errorf("Expected the client's ID back once but got %v", ids)
+	}
+
+	r = httptest.NewRequest("GET", "/api/users", nil)
+	r.Header.Set("X-Correlation-Id", `bad"id`)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, r)
+	if !uuidPattern.MatchString(res.Header().Get("X-Correlation-Id")) {
+		t.Errorf("Expected an unsafe ID to be replaced but got '%s'", res.Header().Get("X-Correlation-Id"))
+	}
+}
+
+func TestRequestIDInErrors(t *testing.T) {
+	tests := map[string]http.HandlerFunc{
+		"no_matching_mount_point": noMatchingMountPointHandler,
+		"no_healthy_backends":     noHealthyBackends,
+	}
+	for name, errorHandler := range tests {
+		r := httptest.NewRequest("GET", "/nowhere", nil)
+		r.Header.Set("X-Request-Id", "abc-123")
+		res := httptest.NewRecorder()
+		NewRequestIDs("X-Request-Id").Wrap(errorHandler).ServeHTTP(res, r)
+		if !strings.Contains(res.Body.String(), `"error":"`+name+`"`) ||
+			!strings.HasSuffix(strings.TrimSpace(res.Body.String()), `"request_id":"abc-123"}`) {
+			t.Errorf("Expected the %s error to include the request ID but got %s", name, res.Body.String())
+		}
+	}
+}
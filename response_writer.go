@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// statusWriter remembers the status code and body size of a response while
+// passing everything through to the real ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newStatusWriter(w http.ResponseWriter) *statusWriter {
+	return &statusWriter{ResponseWriter: w}
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Status returns the status sent, or 200 if the handler never set one
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *statusWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recordingWriter keeps a copy of the response it passes through, as long as
+// the body stays under limit
+type recordingWriter struct {
+	http.ResponseWriter
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func newRecordingWriter(w http.ResponseWriter, limit int64) *recordingWriter {
+	return &recordingWriter{ResponseWriter: w, limit: limit}
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.truncated {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.truncated = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Complete reports whether the whole response was recorded
+func (w *recordingWriter) Complete() bool {
+	return w.status != 0 && !w.truncated
+}
+
+// Replay sends the recorded response to another client
+func (w *recordingWriter) Replay(dst http.ResponseWriter) {
+	header := dst.Header()
+	for k, v := range w.header {
+		header[k] = append([]string(nil), v...)
+	}
+	dst.WriteHeader(w.status)
+	dst.Write(w.body.Bytes())
+}
+
+func (w *recordingWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
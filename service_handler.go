@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+)
+
+// NewServiceHandler wraps the reverse proxy for a service with everything its
+// definition asks for. The first wrapper here is the last to see the request.
+// auth is the reverse proxy for the service's AuthService, if it has one.
+func NewServiceHandler(s Service, proxy, auth http.Handler, upgrades *UpgradeTracker, peers *Peers, faults *Faults, access *Access) http.Handler {
+	handler := proxy
+	if s.Type == ServiceTypeGRPC {
+		handler = NewGRPCHandler(handler)
+	}
+
+	idleTimeout := config.UpgradeIdleTimeout
+	if s.UpgradeIdleTimeout.Duration != 0 {
+		idleTimeout = s.UpgradeIdleTimeout.Duration
+	}
+	handler = upgrades.Wrap(s.MountPoint, idleTimeout, handler)
+
+	handler = NewConcurrencyLimitHandler(s, handler)
+
+	handler = NewCoalesceHandler(s, handler)
+
+	// Cache hits don't take a concurrency slot
+	handler = NewCacheHandler(s, handler)
+
+	// The cache keeps plain responses and each client gets its own encoding
+	handler = NewCompressionHandler(s, handler)
+
+	// The authorization service only hears about requests with a valid token
+	handler = NewAuthRequestHandler(s, auth, handler)
+
+	// Only authenticated requests get cached responses or a slot. Rate limits
+	// still count the rest.
+	handler = NewJWTHandler(s, handler)
+
+	// Turned away clients and wrong passwords still count towards rate limits
+	handler = access.Wrap(s, handler)
+
+	handler = NewRateLimitHandler(s, peers, handler)
+
+	// Faults stand in for the whole service, cache and limits included
+	handler = faults.Wrap(s, handler)
+
+	// Preflights don't need credentials, and conductor's own errors get CORS
+	// headers too so scripts can read them
+	handler = NewCORSHandler(s, handler)
+	return handler
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The version that gets whatever traffic the split versions don't
+const StableVersion = "stable"
+
+// SplitConfig sends a share of a mount point's traffic to other versions of
+// the service, eg
+// {"versions": [{"name": "canary", "tag": "canary", "weight": 5}], "sticky": "cookie"}
+type SplitConfig struct {
+	Versions []VersionConfig `json:"versions"`
+	// Requests can pick a version by name, including "stable", with this
+	// header or cookie. Default to X-Conductor-Version and conductor_version.
+	Header string `json:"header"`
+	Cookie string `json:"cookie"`
+	// How clients keep their version: "cookie" (the default) remembers it in
+	// a cookie, "ip" and "header:<name>" hash the client IP or a header and
+	// "none" picks again for every request.
+	Sticky string `json:"sticky"`
+}
+
+// VersionConfig is one version of a service in a split
+type VersionConfig struct {
+	// Anything but "stable", "mirror" and "auth", which are taken
+	Name string `json:"name"`
+	// The Consul service to send traffic to. Defaults to the split service.
+	Service string `json:"service"`
+	// Only nodes with this Consul tag are part of the version. When the version
+	// is the same Consul service, the stable version leaves these nodes out.
+	Tag string `json:"tag"`
+	// Percentage of traffic, eg 5 or 0.5
+	Weight float64 `json:"weight"`
+}
+
+// The cookie that keeps a client in the same place when Sticky is "cookie"
+const splitBucketCookie = "conductor_bucket"
+
+// Traffic is divided into this many buckets, so weights can go down to 0.01%
+const splitBuckets = 10000
+
+func (c SplitConfig) header() string {
+	if c.Header == "" {
+		return "X-Conductor-Version"
+	}
+	return c.Header
+}
+
+func (c SplitConfig) cookie() string {
+	if c.Cookie == "" {
+		return "conductor_version"
+	}
+	return c.Cookie
+}
+
+// VersionFor returns the version a bucket falls in. Versions take buckets from
+// the bottom in order, so raising a weight only moves clients onto a version
+// and lowering it only moves them off.
+func (c SplitConfig) VersionFor(bucket int) string {
+	upTo := 0.0
+	for _, v := range c.Versions {
+		upTo += v.Weight * splitBuckets / 100
+		if float64(bucket) < upTo {
+			return v.Name
+		}
+	}
+	return StableVersion
+}
+
+// validVersions drops versions without a name of their own, which would share
+// a balancer and proxy with another version
+func (c SplitConfig) validVersions(service string) []VersionConfig {
+	var versions []VersionConfig
+	seen := map[string]bool{StableVersion: true, MirrorVersion: true, AuthRequestVersion: true}
+	for _, v := range c.Versions {
+		if v.Name == "" || seen[v.Name] {
+			log.WithFields(log.Fields{"service": service,
+				"version": v.Name}).Error("Version names in a split have to be unique and not stable, mirror or auth, ignoring")
+			continue
+		}
+		seen[v.Name] = true
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// excludedTags returns the tags of versions that share the stable version's
+// Consul service, which the stable version has to leave out
+func (c SplitConfig) excludedTags(service string) []string {
+	var tags []string
+	for _, v := range c.Versions {
+		if v.Tag != "" && (v.Service == "" || v.Service == service) {
+			tags = append(tags, v.Tag)
+		}
+	}
+	return tags
+}
+
+// VersionServices returns a service for each version in the split. They share
+// the mount point and backend settings and are balanced like any other service.
+func (s Service) VersionServices() ServiceList {
+	var list ServiceList
+	for _, v := range s.Split.Versions {
+		name := v.Service
+		if name == "" {
+			name = s.Name
+		}
+		list = append(list, &Service{
+			Name:       name,
+			MountPoint: s.MountPoint,
+			Type:       s.Type,
+			Backend:    s.Backend,
+			Version:    v.Name,
+			Tag:        v.Tag,
+		})
+	}
+	return list
+}
+
+// WithVersions returns the list with a service added for every split version
+func (list ServiceList) WithVersions() *ServiceList {
+	all := append(ServiceList{}, list...)
+	for _, s := range list {
+		all = append(all, s.VersionServices()...)
+	}
+	return &all
+}
+
+// Splitter picks a version for each request and hands it to that version's
+// reverse proxy. Weights can be changed while running.
+type Splitter struct {
+	mu         sync.RWMutex
+	mountPoint string
+	config     SplitConfig
+	proxies    map[string]http.Handler
+	random     func(n int) int
+}
+
+// NewSplitter needs a proxy for the stable version and each version in the split
+func NewSplitter(s Service, proxies map[string]http.Handler) *Splitter {
+	return &Splitter{mountPoint: s.MountPoint, config: s.Split, proxies: proxies, random: rand.Intn}
+}
+
+// Update takes new weights and settings from a changed service definition.
+// Versions that weren't there at startup need a restart.
+func (sp *Splitter) Update(s Service) {
+	config := s.Split
+	var versions []VersionConfig
+	for _, v := range config.Versions {
+		if _, ok := sp.proxies[v.Name]; !ok {
+			log.WithFields(log.Fields{"mount_point": sp.mountPoint,
+				"version": v.Name}).Warn("New versions in a split need a restart, ignoring")
+			continue
+		}
+		versions = append(versions, v)
+	}
+	config.Versions = versions
+
+	sp.mu.Lock()
+	sp.config = config
+	sp.mu.Unlock()
+
+	fields := log.Fields{"mount_point": sp.mountPoint}
+	for _, v := range versions {
+		fields[v.Name] = v.Weight
+	}
+	log.WithFields(fields).Info("Updated traffic split")
+}
+
+func (sp *Splitter) Config() SplitConfig {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.config
+}
+
+func (sp *Splitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version := sp.Choose(w, r)
+	log.WithFields(log.Fields{"mount_point": sp.mountPoint,
+		"version": version}).Debug("Picked version")
+	if entry := accessLogEntryFrom(r); entry != nil {
+		entry.Version = version
+	}
+	sp.proxies[version].ServeHTTP(w, r)
+}
+
+// Choose returns the version for a request: the one it asks for if that
+// exists, otherwise whichever its bucket falls in
+func (sp *Splitter) Choose(w http.ResponseWriter, r *http.Request) string {
+	config := sp.Config()
+	if version := r.Header.Get(config.header()); sp.proxies[version] != nil {
+		return version
+	}
+	if cookie, err := r.Cookie(config.cookie()); err == nil && sp.proxies[cookie.Value] != nil {
+		return cookie.Value
+	}
+	return config.VersionFor(sp.bucket(w, r, config))
+}
+
+// bucket places the client somewhere in [0, splitBuckets)
+func (sp *Splitter) bucket(w http.ResponseWriter, r *http.Request, config SplitConfig) int {
+	switch {
+	case config.Sticky == "ip":
+		return hashBucket(clientIP(r))
+	case strings.HasPrefix(config.Sticky, "header:"):
+		if value := r.Header.Get(strings.TrimPrefix(config.Sticky, "header:")); value != "" {
+			return hashBucket(value)
+		}
+	case config.Sticky == "" || config.Sticky == "cookie":
+		if cookie, err := r.Cookie(splitBucketCookie); err == nil {
+			if bucket, err := strconv.Atoi(cookie.Value); err == nil && bucket >= 0 && bucket < splitBuckets {
+				return bucket
+			}
+		}
+		bucket := sp.random(splitBuckets)
+		http.SetCookie(w, &http.Cookie{Name: splitBucketCookie, Value: fmt.Sprint(bucket), Path: "/",
+			MaxAge: 30 * 24 * 60 * 60, HttpOnly: true})
+		return bucket
+	}
+	return sp.random(splitBuckets)
+}
+
+func hashBucket(value string) int {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return int(h.Sum32() % splitBuckets)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func canaryService(weight float64) Service {
+	return Service{Name: "api", MountPoint: "/api", Split: SplitConfig{
+		Versions: []VersionConfig{{Name: "canary", Tag: "canary", Weight: weight}},
+	}}
+}
+
+// versionHandler answers with the version's name so tests can see where a
+// request went
+func versionHandler(version string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(version))
+	})
+}
+
+func newTestSplitter(s Service) *Splitter {
+	return NewSplitter(s, map[string]http.Handler{
+		StableVersion: versionHandler(StableVersion),
+		"canary":      versionHandler("canary"),
+	})
+}
+
+func splitGet(sp *Splitter, setup func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	if setup != nil {
+		setup(r)
+	}
+	res := httptest.NewRecorder()
+	sp.ServeHTTP(res, r)
+	return res
+}
+
+func TestSplitConfigVersionFor(t *testing.T) {
+	c := SplitConfig{Versions: []VersionConfig{{Name: "canary", Weight: 5}, {Name: "beta", Weight: 0.5}}}
+	tests := map[int]string{0: "canary", 499: "canary", 500: "beta", 549: "beta", 550: StableVersion, 9999: StableVersion}
+	for bucket, expected := range tests {
+		if version := c.VersionFor(bucket); version != expected {
+			t.Errorf("Expected bucket %d to get '%s' but got '%s'", bucket, expected, version)
+		}
+	}
+}
+
+func TestVersionServices(t *testing.T) {
+	s := ParseServiceDefinition("api", []byte(`{"split": {"versions": [
+		{"name": "canary", "tag": "canary", "weight": 5},
+		{"name": "v2", "service": "api-v2", "weight": 10}
+	]}}`))
+	if len(s.ExcludeTags) != 1 || s.ExcludeTags[0] != "canary" {
+		t.Errorf("Expected the stable version to leave out canary nodes but got %v", s.ExcludeTags)
+	}
+
+	versions := s.VersionServices()
+	if len(versions) != 2 {
+		t.Fatalf("Expected a service for each version but got %d", len(versions))
+	}
+	canary, v2 := versions[0], versions[1]
+	if canary.Name != "api" || canary.Tag != "canary" || canary.Key() != "/api@canary" {
+		t.Errorf("Expected the canary to be api nodes tagged canary but got %+v", canary)
+	}
+	if v2.Name != "api-v2" || v2.Tag != "" || v2.MountPoint != "/api" {
+		t.Errorf("Expected v2 to be the api-v2 service on /api but got %+v", v2)
+	}
+}
+
+func TestSplitVersionNames(t *testing.T) {
+	s := ParseServiceDefinition("api", []byte(`{"split": {"versions": [
+		{"name": "stable", "weight": 5}, {"name": "mirror", "weight": 5}, {"name": "auth", "weight": 5},
+		{"weight": 5}, {"name": "canary", "weight": 5}, {"name": "canary", "service": "api-v2", "weight": 5}
+	]}}`))
+	if len(s.Split.Versions) != 1 || s.Split.Versions[0].Name != "canary" || s.Split.Versions[0].Service != "" {
+		t.Errorf("Expected only the first canary to be kept but got %+v", s.Split.Versions)
+	}
+}
+
+func TestSplitTurnsOffCacheAndCoalesce(t *testing.T) {
+	s := canaryService(5)
+	s.Cache.Enabled = true
+	s.Coalesce.Enabled = true
+	handler := http.NotFoundHandler()
+	if _, ok := NewCacheHandler(s, handler).(*ResponseCache); ok {
+		t.Error("Expected responses not to be cached across versions")
+	}
+	if _, ok := NewCoalesceHandler(s, handler).(*Coalescer); ok {
+		t.Error("Expected requests not to be coalesced across versions")
+	}
+}
+
+func TestSplitterWeights(t *testing.T) {
+	sp := newTestSplitter(canaryService(25))
+	sp.config.Sticky = "none"
+	buckets := []int{100, 2600, 2400, 9000}
+	sp.random = func(n int) int {
+		bucket := buckets[0]
+		buckets = buckets[1:]
+		return bucket
+	}
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, splitGet(sp, nil).Body.String())
+	}
+	if strings.Join(got, ",") != "canary,stable,canary,stable" {
+		t.Errorf("Expected a quarter of the buckets to go to the canary but got %v", got)
+	}
+}
+
+func TestSplitterOverrides(t *testing.T) {
+	sp := newTestSplitter(canaryService(0))
+
+	res := splitGet(sp, func(r *http.Request) { r.Header.Set("X-Conductor-Version", "canary") })
+	if res.Body.String() != "canary" {
+		t.Errorf("Expected the header to force the canary but got '%s'", res.Body.String())
+	}
+	res = splitGet(sp, func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "conductor_version", Value: "canary"}) })
+	if res.Body.String() != "canary" {
+		t.Errorf("Expected the cookie to force the canary but got '%s'", res.Body.String())
+	}
+	res = splitGet(sp, func(r *http.Request) { r.Header.Set("X-Conductor-Version", "nonsense") })
+	if res.Body.String() != StableVersion {
+		t.Errorf("Expected an unknown version to be ignored but got '%s'", res.Body.String())
+	}
+}
+
+func TestSplitterStickyCookie(t *testing.T) {
+	sp := newTestSplitter(canaryService(10))
+	sp.random = func(n int) int { return 42 }
+
+	res := splitGet(sp, nil)
+	if res.Body.String() != "canary" {
+		t.Fatalf("Expected bucket 42 to get the canary but got '%s'", res.Body.String())
+	}
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "conductor_bucket" || cookies[0].Value != "42" {
+		t.Fatalf("Expected the bucket to be remembered in a cookie but got %v", cookies)
+	}
+
+	sp.random = func(n int) int { return 9999 }
+	res = splitGet(sp, func(r *http.Request) { r.AddCookie(cookies[0]) })
+	if res.Body.String() != "canary" || len(res.Result().Cookies()) != 0 {
+		t.Errorf("Expected the client to stay on the canary but got '%s'", res.Body.String())
+	}
+
+	// Rolling the canary back moves everyone off it
+	sp.Update(canaryService(0))
+	res = splitGet(sp, func(r *http.Request) { r.AddCookie(cookies[0]) })
+	if res.Body.String() != StableVersion {
+		t.Errorf("Expected a weight of zero to send the client to stable but got '%s'", res.Body.String())
+	}
+}
+
+func TestSplitterStickyHeader(t *testing.T) {
+	s := canaryService(50)
+	s.Split.Sticky = "header:X-User-Id"
+	sp := newTestSplitter(s)
+	sp.random = func(n int) int { t.Fatal("Expected the header to pick the bucket"); return 0 }
+
+	first := splitGet(sp, func(r *http.Request) { r.Header.Set("X-User-Id", "1234") }).Body.String()
+	for i := 0; i < 5; i++ {
+		if version := splitGet(sp, func(r *http.Request) { r.Header.Set("X-User-Id", "1234") }).Body.String(); version != first {
+			t.Fatalf("Expected the same user to stay on '%s' but got '%s'", first, version)
+		}
+	}
+}
+
+func TestSplitterIgnoresNewVersionsOnUpdate(t *testing.T) {
+	sp := newTestSplitter(canaryService(5))
+	updated := canaryService(20)
+	updated.Split.Versions = append(updated.Split.Versions, VersionConfig{Name: "beta", Weight: 50})
+	sp.Update(updated)
+
+	c := sp.Config()
+	if len(c.Versions) != 1 || c.Versions[0].Weight != 20 {
+		t.Errorf("Expected only the canary weight to change but got %+v", c.Versions)
+	}
+}
+
+func TestConsulServiceWorker(t *testing.T) {
+	fake := &fakeConsul{index: 1, registered: make(map[string]bool), kv: map[string][]byte{
+		"conductor/services/api": []byte(`{"split": {"versions": [{"name": "canary", "weight": 5}]}}`),
+	}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	c, err := NewConsul(strings.TrimPrefix(ts.URL, "http://"), "dc1", "conductor/services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := canaryService(5)
+	sp := newTestSplitter(s)
+	w := NewConsulServiceWorker(c, s)
+	w.queryOptions.WaitTime = 10 * time.Millisecond
+	w.Subscribe(sp.Update)
+	go w.Work()
+	defer func() { w.ControlChan <- true }()
+
+	fake.setKV("conductor/services/api", []byte(`{"split": {"versions": [{"name": "canary", "weight": 30}]}}`))
+	waitFor(t, func() bool { return sp.Config().Versions[0].Weight == 30 })
+
+	// Consul restored from a snapshot goes back to an older index
+	fake.mu.Lock()
+	fake.index = 1
+	fake.kv["conductor/services/api"] = []byte(`{"split": {"versions": [{"name": "canary", "weight": 40}]}}`)
+	fake.mu.Unlock()
+	waitFor(t, func() bool { return sp.Config().Versions[0].Weight == 40 })
+}
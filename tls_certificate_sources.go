@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KVLister is the part of the Consul KV API we need to watch a prefix. It is
+// satisfied by *api.KV and by SecretDirectory.
+type KVLister interface {
+	List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error)
+}
+
+// ParseCertificateBundle splits a PEM bundle holding a certificate chain and a
+// private key and returns the certificate.
+func ParseCertificateBundle(bundle []byte) (*tls.Certificate, error) {
+	var certPEM, keyPEM []byte
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+	if certPEM == nil || keyPEM == nil {
+		return nil, fmt.Errorf("bundle needs both a certificate and a private key")
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+type certificateUpdate struct {
+	pairs   api.KVPairs
+	changed bool
+}
+
+// CertificateKVWorker watches a KV prefix holding PEM bundles keyed by host
+// name, eg conductor/certs/api.example.com, and keeps the store in sync.
+type CertificateKVWorker struct {
+	ControlChan  chan bool
+	InputChan    chan certificateUpdate
+	source       string
+	prefix       string
+	kv           KVLister
+	store        *CertificateStore
+	certs        map[string]*tls.Certificate
+	queryOptions *api.QueryOptions
+	lastIndex    uint64
+}
+
+func NewCertificateKVWorker(source string, kv KVLister, prefix string, store *CertificateStore) *CertificateKVWorker {
+	return &CertificateKVWorker{
+		ControlChan:  make(chan bool, 1),
+		InputChan:    make(chan certificateUpdate, 1),
+		source:       source,
+		prefix:       strings.TrimSuffix(prefix, "/"),
+		kv:           kv,
+		store:        store,
+		certs:        make(map[string]*tls.Certificate),
+		queryOptions: &api.QueryOptions{WaitTime: time.Duration(30) * time.Second, RequireConsistent: true},
+	}
+}
+
+// Load does a single non-blocking read of the prefix so certificates are in
+// place before we start serving.
+func (w *CertificateKVWorker) Load() error {
+	pairs, queryMeta, err := w.kv.List(w.listPrefix(), &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return err
+	}
+	w.lastIndex = queryMeta.LastIndex
+	w.queryOptions.WaitIndex = queryMeta.LastIndex
+	w.update(pairs)
+	return nil
+}
+
+func (w *CertificateKVWorker) Work() {
+	go w.BlockUntilKVUpdate()
+	for {
+		select {
+		case result := <-w.InputChan:
+			if result.changed {
+				w.update(result.pairs)
+			}
+			go w.BlockUntilKVUpdate()
+		case _ = <-w.ControlChan:
+			return
+		}
+	}
+}
+
+func (w *CertificateKVWorker) BlockUntilKVUpdate() {
+	pairs, queryMeta, err := w.kv.List(w.listPrefix(), w.queryOptions)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"prefix":      w.prefix,
+			"source":      w.source,
+			"error":       err,
+			"last_index":  w.lastIndex,
+			"worker_type": "certificate_kv"}).Error("Error getting certificates")
+		time.Sleep(time.Duration(7) * time.Second)
+		w.InputChan <- certificateUpdate{}
+		return
+	}
+
+	if queryMeta.LastIndex == w.lastIndex {
+		w.InputChan <- certificateUpdate{}
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"prefix":      w.prefix,
+		"source":      w.source,
+		"last_index":  w.lastIndex,
+		"new_index":   queryMeta.LastIndex,
+		"worker_type": "certificate_kv"}).Debug("Certificates changed")
+	if queryMeta.LastIndex < w.lastIndex {
+		// Consul's state was reset, eg restored from a snapshot, so start over
+		// rather than wait for an index that may never come
+		w.lastIndex = 0
+		w.queryOptions.WaitIndex = 0
+	} else {
+		w.lastIndex = queryMeta.LastIndex
+		w.queryOptions.WaitIndex = queryMeta.LastIndex
+	}
+	w.InputChan <- certificateUpdate{pairs: pairs, changed: true}
+}
+
+// listPrefix ends in a slash so a prefix of conductor/certs doesn't pick up
+// conductor/certs-old
+func (w *CertificateKVWorker) listPrefix() string {
+	return w.prefix + "/"
+}
+
+// update parses every bundle under the prefix. A bundle that fails to parse
+// keeps whatever certificate we last had for that host.
+func (w *CertificateKVWorker) update(pairs api.KVPairs) {
+	certs := make(map[string]*tls.Certificate, len(pairs))
+	for _, kv := range pairs {
+		host := strings.TrimPrefix(kv.Key, w.prefix+"/")
+		if host == "" || strings.HasSuffix(host, "/") || len(kv.Value) == 0 {
+			continue
+		}
+		cert, err := ParseCertificateBundle(kv.Value)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"key":         kv.Key,
+				"source":      w.source,
+				"error":       err,
+				"worker_type": "certificate_kv"}).Error("Could not parse certificate bundle")
+			if old, ok := w.certs[host]; ok {
+				certs[host] = old
+			}
+			continue
+		}
+		certs[host] = cert
+	}
+	w.certs = certs
+	w.store.SetNamedCertificates(w.source, certs)
+	log.WithFields(log.Fields{
+		"prefix":       w.prefix,
+		"source":       w.source,
+		"certificates": len(certs),
+		"worker_type":  "certificate_kv"}).Info("Loaded certificates")
+}
+
+// SecretDirectory presents a directory of PEM bundles, like the ones rendered
+// by a Vault agent, as if it were a Consul KV prefix. Files are keyed by name,
+// so /secrets/api.example.com becomes <prefix>/api.example.com. Blocking
+// queries poll the directory until it changes or the wait time runs out.
+type SecretDirectory struct {
+	Path         string
+	PollInterval time.Duration
+}
+
+func NewSecretDirectory(path string) *SecretDirectory {
+	return &SecretDirectory{Path: path, PollInterval: time.Second}
+}
+
+func (d *SecretDirectory) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	deadline := time.Now()
+	if q != nil && q.WaitIndex != 0 {
+		deadline = deadline.Add(q.WaitTime)
+	}
+	for {
+		pairs, index, err := d.read(prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		if q == nil || index != q.WaitIndex || !time.Now().Before(deadline) {
+			return pairs, &api.QueryMeta{LastIndex: index}, nil
+		}
+		time.Sleep(d.PollInterval)
+	}
+}
+
+// read loads every regular file in the directory. The index is a hash of the
+// names, sizes and modification times so any change gives a new one.
+func (d *SecretDirectory) read(prefix string) (api.KVPairs, uint64, error) {
+	entries, err := ioutil.ReadDir(d.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	hash := fnv.New64a()
+	pairs := make(api.KVPairs, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		value, err := ioutil.ReadFile(filepath.Join(d.Path, entry.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, 0, err
+		}
+		fmt.Fprintf(hash, "%s:%d:%d;", entry.Name(), entry.Size(), entry.ModTime().UnixNano())
+		pairs = append(pairs, &api.KVPair{
+			Key:   fmt.Sprintf("%s/%s", strings.TrimSuffix(prefix, "/"), entry.Name()),
+			Value: value,
+		})
+	}
+	// Zero is the "no index yet" value so never hand it out
+	return pairs, hash.Sum64() | 1, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCertificateBundle(t *testing.T) {
+	certPEM, keyPEM := generateCertificate(t, "api.example.com")
+
+	cert, err := ParseCertificateBundle(append(keyPEM, certPEM...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.DNSNames[0] != "api.example.com" {
+		t.Errorf("Expected certificate for api.example.com but got %v", cert.Leaf.DNSNames)
+	}
+
+	if _, err := ParseCertificateBundle(certPEM); err == nil {
+		t.Error("Expected an error for a bundle with no private key")
+	}
+}
+
+func TestCertificateKVWorkerWithSecretDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conductor-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeBundle := func(host string, names ...string) {
+		certPEM, keyPEM := generateCertificate(t, names...)
+		ioutil.WriteFile(filepath.Join(dir, host), append(certPEM, keyPEM...), 0600)
+	}
+	writeBundle("api.example.com", "api.example.com")
+
+	secrets := NewSecretDirectory(dir)
+	secrets.PollInterval = 10 * time.Millisecond
+	store := NewCertificateStore()
+	w := NewCertificateKVWorker("secret_dir", secrets, "secrets", store)
+	w.queryOptions.WaitTime = 50 * time.Millisecond
+
+	if err := w.Load(); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.DNSNames[0] != "api.example.com" {
+		t.Errorf("Expected certificate for api.example.com but got %v", cert.Leaf.DNSNames)
+	}
+
+	// Nothing changed so the blocking query times out with no update
+	go w.BlockUntilKVUpdate()
+	if result := <-w.InputChan; result.changed {
+		t.Error("Expected no update when the directory has not changed")
+	}
+
+	// The key is the host name even when the certificate doesn't say so
+	writeBundle("www.example.com", "legacy.example.com")
+	go w.BlockUntilKVUpdate()
+	result := <-w.InputChan
+	if !result.changed {
+		t.Fatal("Expected an update after adding a bundle")
+	}
+	w.update(result.pairs)
+
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.DNSNames[0] != "legacy.example.com" {
+		t.Errorf("Expected certificate keyed by www.example.com but got %v", cert.Leaf.DNSNames)
+	}
+
+	// A broken bundle keeps the last good certificate for that host
+	ioutil.WriteFile(filepath.Join(dir, "api.example.com"), []byte("garbage"), 0600)
+	pairs, _, err := secrets.List("secrets", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.update(pairs)
+	cert, _ = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	if cert.Leaf.DNSNames[0] != "api.example.com" {
+		t.Errorf("Expected to keep the old api.example.com certificate but got %v", cert.Leaf.DNSNames)
+	}
+}
+
+// fakeKV hands out the pairs under a prefix with whatever index it is given
+type fakeKV struct {
+	pairs    api.KVPairs
+	index    uint64
+	prefixes []string
+	waits    []uint64
+}
+
+func (f *fakeKV) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	f.prefixes = append(f.prefixes, prefix)
+	f.waits = append(f.waits, q.WaitIndex)
+	var pairs api.KVPairs
+	for _, kv := range f.pairs {
+		if strings.HasPrefix(kv.Key, prefix) {
+			pairs = append(pairs, kv)
+		}
+	}
+	return pairs, &api.QueryMeta{LastIndex: f.index}, nil
+}
+
+func TestCertificateKVWorkerPrefixAndIndex(t *testing.T) {
+	certPEM, keyPEM := generateCertificate(t, "api.example.com")
+	bundle := append(certPEM, keyPEM...)
+	kv := &fakeKV{index: 10, pairs: api.KVPairs{
+		{Key: "conductor/certs/api.example.com", Value: bundle},
+		{Key: "conductor/certs-old/old.example.com", Value: bundle},
+	}}
+	store := NewCertificateStore()
+	w := NewCertificateKVWorker("consul_kv", kv, "conductor/certs", store)
+
+	if err := w.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if kv.prefixes[0] != "conductor/certs/" || len(w.certs) != 1 || w.certs["api.example.com"] == nil {
+		t.Errorf("Expected only the bundles under conductor/certs/ but listed %v and got %v", kv.prefixes, w.certs)
+	}
+
+	// Consul was restored from an older snapshot
+	kv.index = 5
+	go w.BlockUntilKVUpdate()
+	if result := <-w.InputChan; !result.changed {
+		t.Error("Expected an update when the index goes backwards")
+	}
+	kv.index = 6
+	go w.BlockUntilKVUpdate()
+	<-w.InputChan
+	if kv.waits[1] != 10 || kv.waits[2] != 0 {
+		t.Errorf("Expected the wait index to start over after going backwards but waited on %v", kv.waits)
+	}
+	if w.queryOptions.WaitIndex != 6 {
+		t.Errorf("Expected to wait on the new index but got %d", w.queryOptions.WaitIndex)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CertificateStore picks a certificate for each TLS handshake by SNI. Sets of
+// certificates are kept per source so each source can be reloaded on its own.
+type CertificateStore struct {
+	mu       sync.RWMutex
+	sources  map[string]map[string]*tls.Certificate
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func NewCertificateStore() *CertificateStore {
+	return &CertificateStore{
+		sources: make(map[string]map[string]*tls.Certificate),
+		byName:  make(map[string]*tls.Certificate),
+	}
+}
+
+// SetCertificates replaces every certificate previously loaded from source.
+// They are picked by the names in the certificates themselves.
+func (s *CertificateStore) SetCertificates(source string, certs []*tls.Certificate) {
+	named := make(map[string]*tls.Certificate, len(certs))
+	for i, cert := range certs {
+		named[fmt.Sprintf("%08d", i)] = cert
+	}
+	s.setSource(source, named)
+}
+
+// SetNamedCertificates replaces every certificate previously loaded from source.
+// Each certificate is picked by its host name key as well as the names in the
+// certificate.
+func (s *CertificateStore) SetNamedCertificates(source string, certs map[string]*tls.Certificate) {
+	named := make(map[string]*tls.Certificate, len(certs))
+	for host, cert := range certs {
+		named[strings.ToLower(host)] = cert
+	}
+	s.setSource(source, named)
+}
+
+func (s *CertificateStore) setSource(source string, certs map[string]*tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(certs) == 0 {
+		delete(s.sources, source)
+	} else {
+		s.sources[source] = certs
+	}
+
+	// Rebuild the index in a stable order so the fallback doesn't move around.
+	// Certificate files given on the command line always provide the fallback.
+	sources := make([]string, 0, len(s.sources))
+	for name := range s.sources {
+		if name != "files" {
+			sources = append(sources, name)
+		}
+	}
+	sort.Strings(sources)
+	if _, ok := s.sources["files"]; ok {
+		sources = append([]string{"files"}, sources...)
+	}
+
+	s.byName = make(map[string]*tls.Certificate)
+	s.fallback = nil
+	for _, source := range sources {
+		keys := make([]string, 0, len(s.sources[source]))
+		for key := range s.sources[source] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			cert := s.sources[source][key]
+			if s.fallback == nil {
+				s.fallback = cert
+			}
+			for _, host := range certificateNames(cert) {
+				s.byName[strings.ToLower(host)] = cert
+			}
+		}
+		// Explicit host names win over the names inside other certificates
+		for _, key := range keys {
+			if strings.Contains(key, ".") {
+				s.byName[key] = s.sources[source][key]
+			}
+		}
+	}
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. Exact names win over
+// wildcards, and the first certificate loaded is used when nothing matches.
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if s.fallback == nil {
+		return nil, fmt.Errorf("no certificate available for '%s'", hello.ServerName)
+	}
+	return s.fallback, nil
+}
+
+// certificateNames returns the host names a certificate is valid for
+func certificateNames(cert *tls.Certificate) []string {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return nil
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil
+		}
+		leaf = parsed
+		cert.Leaf = parsed
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames
+	}
+	if leaf.Subject.CommonName != "" {
+		return []string{leaf.Subject.CommonName}
+	}
+	return nil
+}
+
+// NewTLSConfig builds the server side TLS configuration from the command line
+func NewTLSConfig(store *CertificateStore, minVersion string, cipherNames string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version '%s'", minVersion)
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     version,
+	}
+	if cipherNames == "" {
+		return tlsConfig, nil
+	}
+
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Split(cipherNames, ",") {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return tlsConfig, nil
+}
+
+// CertificatePair is a certificate and key file on disk
+type CertificatePair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ParseCertificatePairs matches up comma separated lists of cert and key files
+func ParseCertificatePairs(certFiles, keyFiles string) ([]CertificatePair, error) {
+	if certFiles == "" && keyFiles == "" {
+		return nil, nil
+	}
+	certs := strings.Split(certFiles, ",")
+	keys := strings.Split(keyFiles, ",")
+	if len(certs) != len(keys) {
+		return nil, fmt.Errorf("got %d certificate files but %d key files", len(certs), len(keys))
+	}
+	pairs := make([]CertificatePair, len(certs))
+	for i := range certs {
+		pairs[i] = CertificatePair{CertFile: strings.TrimSpace(certs[i]), KeyFile: strings.TrimSpace(keys[i])}
+	}
+	return pairs, nil
+}
+
+// CertificateFileWorker loads certificates from disk into the store and
+// reloads them whenever one of the files changes.
+type CertificateFileWorker struct {
+	ControlChan chan bool
+	ReloadChan  chan bool
+	pairs       []CertificatePair
+	store       *CertificateStore
+	interval    time.Duration
+	modTimes    map[string]time.Time
+}
+
+func NewCertificateFileWorker(store *CertificateStore, pairs []CertificatePair, interval time.Duration) *CertificateFileWorker {
+	return &CertificateFileWorker{
+		ControlChan: make(chan bool, 1),
+		ReloadChan:  make(chan bool, 1),
+		pairs:       pairs,
+		store:       store,
+		interval:    interval,
+		modTimes:    make(map[string]time.Time),
+	}
+}
+
+// Load reads every certificate pair and swaps them into the store. If any pair
+// fails to load the certificates already in the store are left alone.
+func (w *CertificateFileWorker) Load() error {
+	certs := make([]*tls.Certificate, len(w.pairs))
+	for i, pair := range w.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return err
+		}
+		certs[i] = &cert
+	}
+	w.store.SetCertificates("files", certs)
+	w.changed()
+	return nil
+}
+
+// changed reports whether any file has a new modification time since last call
+func (w *CertificateFileWorker) changed() bool {
+	changed := false
+	for _, pair := range w.pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			if !info.ModTime().Equal(w.modTimes[file]) {
+				w.modTimes[file] = info.ModTime()
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func (w *CertificateFileWorker) Work() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if w.changed() {
+				w.reload()
+			}
+		case <-w.ReloadChan:
+			w.reload()
+		case <-w.ControlChan:
+			return
+		}
+	}
+}
+
+func (w *CertificateFileWorker) reload() {
+	if err := w.Load(); err != nil {
+		log.WithFields(log.Fields{"error": err,
+			"worker_type": "certificate_files"}).Error("Could not reload certificates, keeping the old ones")
+		return
+	}
+	log.WithFields(log.Fields{"certificates": len(w.pairs),
+		"worker_type": "certificate_files"}).Info("Reloaded certificates")
+}
+
+// NewHTTPSRedirectHandler sends every request except health checks to the same
+// URL on the HTTPS port.
+func NewHTTPSRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ping" {
+			pingHandler(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			// An IPv6 address without a port keeps its brackets
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, fmt.Sprintf("%d", httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := fmt.Sprintf("https://%s%s", host, r.URL.RequestURI())
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
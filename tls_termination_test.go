@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generateCertificate returns a PEM encoded self signed certificate and key
+func generateCertificate(t *testing.T, names ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func loadTestCertificate(t *testing.T, names ...string) *tls.Certificate {
+	certPEM, keyPEM := generateCertificate(t, names...)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+func TestCertificateStorePicksBySNI(t *testing.T) {
+	store := NewCertificateStore()
+	api := loadTestCertificate(t, "api.example.com")
+	wildcard := loadTestCertificate(t, "*.example.com")
+	store.SetCertificates("files", []*tls.Certificate{api, wildcard})
+
+	tests := map[string]*tls.Certificate{
+		"api.example.com":   api,
+		"API.example.com.":  api,
+		"www.example.com":   wildcard,
+		"unknown.localhost": api,
+	}
+	for name, expected := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert != expected {
+			t.Errorf("Expected '%s' to get certificate for %v but got %v", name,
+				expected.Leaf.DNSNames, cert.Leaf.DNSNames)
+		}
+	}
+}
+
+func TestCertificateStoreReplacesSource(t *testing.T) {
+	store := NewCertificateStore()
+	store.SetCertificates("files", []*tls.Certificate{loadTestCertificate(t, "old.example.com")})
+	store.SetCertificates("files", []*tls.Certificate{loadTestCertificate(t, "new.example.com")})
+
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "old.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.DNSNames[0] != "new.example.com" {
+		t.Errorf("Expected the old certificate to be replaced but got %v", cert.Leaf.DNSNames)
+	}
+
+	store.SetCertificates("files", nil)
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "new.example.com"}); err == nil {
+		t.Error("Expected an error with no certificates loaded")
+	}
+}
+
+func TestCertificateFileWorkerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conductor-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pair := CertificatePair{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writePair := func(name string, modTime time.Time) {
+		certPEM, keyPEM := generateCertificate(t, name)
+		ioutil.WriteFile(pair.CertFile, certPEM, 0600)
+		ioutil.WriteFile(pair.KeyFile, keyPEM, 0600)
+		os.Chtimes(pair.CertFile, modTime, modTime)
+		os.Chtimes(pair.KeyFile, modTime, modTime)
+	}
+	writePair("first.example.com", time.Now().Add(-time.Minute))
+
+	store := NewCertificateStore()
+	w := NewCertificateFileWorker(store, []CertificatePair{pair}, time.Hour)
+	if err := w.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if w.changed() {
+		t.Error("Expected no changes right after loading")
+	}
+
+	writePair("second.example.com", time.Now())
+	if !w.changed() {
+		t.Fatal("Expected the new files to be noticed")
+	}
+	w.reload()
+
+	cert, _ := store.GetCertificate(&tls.ClientHelloInfo{})
+	if cert.Leaf.DNSNames[0] != "second.example.com" {
+		t.Errorf("Expected reloaded certificate for second.example.com but got %v", cert.Leaf.DNSNames)
+	}
+
+	// A broken file keeps the certificate we already have
+	ioutil.WriteFile(pair.CertFile, []byte("garbage"), 0600)
+	w.reload()
+	cert, _ = store.GetCertificate(&tls.ClientHelloInfo{})
+	if cert.Leaf.DNSNames[0] != "second.example.com" {
+		t.Errorf("Expected to keep the last good certificate but got %v", cert.Leaf.DNSNames)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tlsConfig, err := NewTLSConfig(NewCertificateStore(), "1.3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Expected minimum version TLS 1.3 but got %x", tlsConfig.MinVersion)
+	}
+
+	tlsConfig, err = NewTLSConfig(NewCertificateStore(), "1.2", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Expected a single cipher suite but got %v", tlsConfig.CipherSuites)
+	}
+
+	if _, err := NewTLSConfig(NewCertificateStore(), "1.2", "NOT_A_CIPHER"); err == nil {
+		t.Error("Expected an error for an unknown cipher suite")
+	}
+	if _, err := NewTLSConfig(NewCertificateStore(), "2.0", ""); err == nil {
+		t.Error("Expected an error for an unknown TLS version")
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	handler := NewHTTPSRedirectHandler(8443)
+
+	req := httptest.NewRequest("GET", "http://conductor.example.com:8888/solr/select?q=1", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected a 301 but got %d", res.Code)
+	}
+	expected := "https://conductor.example.com:8443/solr/select?q=1"
+	if res.Header().Get("Location") != expected {
+		t.Errorf("Expected redirect to '%s' but got '%s'", expected, res.Header().Get("Location"))
+	}
+
+	for port, hosts := range map[int]map[string]string{
+		8443: {"[::1]": "https://[::1]:8443/", "[::1]:8888": "https://[::1]:8443/"},
+		443:  {"[::1]": "https://[::1]/", "[::1]:8888": "https://[::1]/", "conductor.example.com": "https://conductor.example.com/"},
+	} {
+		for host, expected := range hosts {
+			req = httptest.NewRequest("GET", "/", nil)
+			req.Host = host
+			res = httptest.NewRecorder()
+			NewHTTPSRedirectHandler(port).ServeHTTP(res, req)
+			if res.Header().Get("Location") != expected {
+				t.Errorf("Expected %s to redirect to '%s' but got '%s'", host, expected, res.Header().Get("Location"))
+			}
+		}
+	}
+
+	req = httptest.NewRequest("GET", "http://conductor.example.com:8888/_ping", nil)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusNoContent {
+		t.Errorf("Expected health checks to stay on plain HTTP but got %d", res.Code)
+	}
+}
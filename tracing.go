@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as OTLP numbers them
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+)
+
+// Span status codes, as OTLP numbers them
+const (
+	SpanStatusUnset = 0
+	SpanStatusError = 2
+)
+
+// SpanContext is what is passed between services to join their spans into one
+// trace
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Sampled    bool
+	TraceState string
+}
+
+func (sc SpanContext) TraceIDString() string { return hex.EncodeToString(sc.TraceID[:]) }
+func (sc SpanContext) SpanIDString() string  { return hex.EncodeToString(sc.SpanID[:]) }
+
+// Traceparent formats the context as a W3C traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceIDString(), sc.SpanIDString(), flags)
+}
+
+// ExtractSpanContext reads a W3C traceparent, or failing that B3 in either its
+// single header or multiple header form
+func ExtractSpanContext(h http.Header) (SpanContext, bool) {
+	if sc, ok := parseTraceparent(h.Get("traceparent")); ok {
+		sc.TraceState = h.Get("tracestate")
+		return sc, true
+	}
+	if b3 := h.Get("b3"); b3 != "" {
+		parts := strings.Split(b3, "-")
+		if len(parts) >= 2 {
+			sampled := ""
+			if len(parts) >= 3 {
+				sampled = parts[2]
+			}
+			return parseB3(parts[0], parts[1], sampled, "")
+		}
+	}
+	return parseB3(h.Get("X-B3-TraceId"), h.Get("X-B3-SpanId"), h.Get("X-B3-Sampled"), h.Get("X-B3-Flags"))
+}
+
+func parseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return sc, false
+	}
+	// Version 00 has exactly four parts. Later versions may add more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if !decodeID(sc.TraceID[:], parts[1]) || !decodeID(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+func parseB3(traceID, spanID, sampled, flags string) (SpanContext, bool) {
+	var sc SpanContext
+	// 64 bit trace IDs are padded on the left
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if !decodeID(sc.TraceID[:], traceID) || !decodeID(sc.SpanID[:], spanID) {
+		return sc, false
+	}
+	sc.Sampled = sampled == "1" || sampled == "true" || sampled == "d" || flags == "1"
+	return sc, true
+}
+
+// decodeID decodes a hex ID that has to fill dst and can't be all zeros
+func decodeID(dst []byte, value string) bool {
+	if len(value) != hex.EncodedLen(len(dst)) {
+		return false
+	}
+	if _, err := hex.Decode(dst, []byte(strings.ToLower(value))); err != nil {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// InjectSpanContext passes the context on as a traceparent, and as B3 too if
+// the request came with B3 headers
+func InjectSpanContext(h http.Header, sc SpanContext) {
+	h.Set("traceparent", sc.Traceparent())
+	if sc.TraceState != "" {
+		h.Set("tracestate", sc.TraceState)
+	}
+	sampled := "0"
+	if sc.Sampled {
+		sampled = "1"
+	}
+	if h.Get("b3") != "" {
+		h.Set("b3", fmt.Sprintf("%s-%s-%s", sc.TraceIDString(), sc.SpanIDString(), sampled))
+	}
+	if h.Get("X-B3-TraceId") != "" {
+		h.Set("X-B3-TraceId", sc.TraceIDString())
+		h.Set("X-B3-SpanId", sc.SpanIDString())
+		h.Set("X-B3-Sampled", sampled)
+		h.Del("X-B3-ParentSpanId")
+		h.Del("X-B3-Flags")
+	}
+}
+
+// Span is one timed operation in a trace
+type Span struct {
+	mu            sync.Mutex
+	tracer        *Tracer
+	Context       SpanContext
+	ParentSpanID  [8]byte
+	Name          string
+	Kind          int
+	Start         time.Time
+	End           time.Time
+	Attributes    map[string]interface{}
+	StatusCode    int
+	StatusMessage string
+}
+
+// SetAttribute records a string, bool, int or float64 attribute
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	s.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+func (s *Span) SetError(message string) {
+	s.mu.Lock()
+	s.StatusCode = SpanStatusError
+	s.StatusMessage = message
+	s.mu.Unlock()
+}
+
+// Finish ends the span and exports it if the trace is sampled
+func (s *Span) Finish() {
+	s.mu.Lock()
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.Context.Sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// Child starts a span under this one
+func (s *Span) Child(name string, kind int) *Span {
+	return s.tracer.start(name, kind, s.Context, true)
+}
+
+type spanKey struct{}
+
+// spanFrom returns the span a request is part of, or nil if it isn't traced
+func spanFrom(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Tracer starts a span for every request and exports the sampled ones
+type Tracer struct {
+	exporter *SpanExporter
+	// Share of new traces to sample, from 0 to 1. Requests that are already
+	// part of a trace keep their caller's decision.
+	sample float64
+	random func() float64
+}
+
+func NewTracer(exporter *SpanExporter, sample float64) *Tracer {
+	return &Tracer{exporter: exporter, sample: sample, random: mathrand.Float64}
+}
+
+func (t *Tracer) start(name string, kind int, parent SpanContext, hasParent bool) *Span {
+	s := &Span{tracer: t, Name: name, Kind: kind, Start: time.Now(), Attributes: make(map[string]interface{})}
+	if hasParent {
+		s.Context = SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled, TraceState: parent.TraceState}
+		s.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = t.random() < t.sample
+	}
+	rand.Read(s.Context.SpanID[:])
+	return s
+}
+
+// Wrap starts a server span for every request handler serves, joining the
+// caller's trace if it sent one
+func (t *Tracer) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, hasParent := ExtractSpanContext(r.Header)
+		span := t.start(r.Method, SpanKindServer, parent, hasParent)
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("client.address", clientIP(r))
+		if id := requestIDFrom(r); id != "" {
+			span.SetAttribute("conductor.request_id", id)
+		}
+		if entry := accessLogEntryFrom(r); entry != nil {
+			entry.TraceID = span.Context.TraceIDString()
+		}
+
+		sw := newStatusWriter(w)
+		handler.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, span)))
+
+		span.SetAttribute("http.response.status_code", sw.Status())
+		if sw.Status() >= http.StatusInternalServerError {
+			span.SetError(http.StatusText(sw.Status()))
+		}
+		span.Finish()
+	})
+}
+
+// tracingTransport records a client span for every request sent to a node and
+// passes the trace on to it
+type tracingTransport struct {
+	http.RoundTripper
+	mountPoint string
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := spanFrom(req.Context())
+	if parent == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	parent.mu.Lock()
+	parent.Name = req.Method + " " + t.mountPoint
+	parent.Attributes["conductor.mount_point"] = t.mountPoint
+	parent.Attributes["conductor.node"] = req.URL.Host
+	parent.mu.Unlock()
+
+	span := parent.Child(req.Method, SpanKindClient)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.path", req.URL.Path)
+	span.SetAttribute("server.address", req.URL.Host)
+	span.SetAttribute("conductor.mount_point", t.mountPoint)
+	defer span.Finish()
+
+	// RoundTrippers mustn't change the request they are given
+	req = req.Clone(req.Context())
+	InjectSpanContext(req.Header, span.Context)
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", res.StatusCode)
+	if res.StatusCode >= http.StatusInternalServerError {
+		span.SetError(http.StatusText(res.StatusCode))
+	}
+	return res, nil
+}
+
+// CloseIdleConnections passes through to the backend transport
+func (t *tracingTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
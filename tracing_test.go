@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCollector is a stand-in OpenTelemetry collector that keeps every span
+// sent to it
+type fakeCollector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+	names []string
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req otlpRequest
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad export", http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		c.names = append(c.names, *rs.Resource.Attributes[0].Value.StringValue)
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func (c *fakeCollector) span(kind int) *otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.spans {
+		if c.spans[i].Kind == kind {
+			return &c.spans[i]
+		}
+	}
+	return nil
+}
+
+func attribute(s *otlpSpan, key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			switch {
+			case a.Value.StringValue != nil:
+				return *a.Value.StringValue
+			case a.Value.IntValue != nil:
+				return *a.Value.IntValue
+			}
+		}
+	}
+	return ""
+}
+
+func TestExtractSpanContext(t *testing.T) {
+	tests := []struct {
+		header, value string
+		traceID       string
+		sampled       bool
+	}{
+		{"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "4bf92f3577b34da6a3ce929d0e0e4736", false},
+		{"b3", "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1", "80f198ee56343ba864fe8b2a57d3eff7", true},
+		{"X-B3-TraceId", "a3ce929d0e0e4736", "0000000000000000a3ce929d0e0e4736", true},
+	}
+	for _, test := range tests {
+		h := http.Header{}
+		h.Set(test.header, test.value)
+		if test.header == "X-B3-TraceId" {
+			h.Set("X-B3-SpanId", "00f067aa0ba902b7")
+			h.Set("X-B3-Sampled", "1")
+		}
+		sc, ok := ExtractSpanContext(h)
+		if !ok || sc.TraceIDString() != test.traceID || sc.Sampled != test.sampled {
+			t.Errorf("Expected %s '%s' to give trace %s but got %+v", test.header, test.value, test.traceID, sc)
+		}
+	}
+
+	for _, invalid := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		h := http.Header{}
+		h.Set("traceparent", invalid)
+		if _, ok := ExtractSpanContext(h); ok {
+			t.Errorf("Expected '%s' to be ignored", invalid)
+		}
+	}
+}
+
+func TestInjectSpanContextKeepsB3(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-B3-TraceId", "a3ce929d0e0e4736")
+	h.Set("X-B3-ParentSpanId", "1111111111111111")
+	sc, _ := ExtractSpanContext(http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}})
+	InjectSpanContext(h, sc)
+	if h.Get("traceparent") != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Expected a traceparent but got '%s'", h.Get("traceparent"))
+	}
+	if h.Get("X-B3-TraceId") != "4bf92f3577b34da6a3ce929d0e0e4736" || h.Get("X-B3-SpanId") != "00f067aa0ba902b7" ||
+		h.Get("X-B3-Sampled") != "1" || h.Get("X-B3-ParentSpanId") != "" {
+		t.Errorf("Expected the B3 headers to be replaced but got %v", h)
+	}
+}
+
+func TestTracingThroughProxy(t *testing.T) {
+	collector := &fakeCollector{}
+	cs := httptest.NewServer(collector)
+	defer cs.Close()
+
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+	proxy, stop := newTestProxy(t, serviceForTestServer("users", "/api", backend))
+	defer stop()
+
+	exporter := NewSpanExporter(cs.URL, "edge-conductor")
+	go exporter.Work()
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	NewTracer(exporter, 0).Wrap(proxy).ServeHTTP(httptest.NewRecorder(), r)
+	exporter.Stop()
+
+	server, client := collector.span(SpanKindServer), collector.span(SpanKindClient)
+	if server == nil || client == nil {
+		t.Fatalf("Expected a server and a client span but got %+v", collector.spans)
+	}
+	if collector.names[0] != "edge-conductor" {
+		t.Errorf("Expected the spans to be exported as edge-conductor but got '%s'", collector.names[0])
+	}
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected the server span to join the caller's trace but got %+v", server)
+	}
+	if server.Name != "GET /api" || attribute(server, "conductor.mount_point") != "/api" ||
+		attribute(server, "conductor.node") != backend.Listener.Addr().String() ||
+		attribute(server, "http.response.status_code") != "200" {
+		t.Errorf("Expected the server span to describe the request but got %+v", server)
+	}
+	if client.ParentSpanID != server.SpanID || client.TraceID != server.TraceID {
+		t.Errorf("Expected the client span under the server span but got %+v", client)
+	}
+
+	sc, ok := ExtractSpanContext(received)
+	if !ok || sc.TraceIDString() != server.TraceID || sc.SpanIDString() != client.SpanID || !sc.Sampled {
+		t.Errorf("Expected the backend to be sent the client span but got '%s'", received.Get("traceparent"))
+	}
+}
+
+func TestTracingUnsampled(t *testing.T) {
+	collector := &fakeCollector{}
+	cs := httptest.NewServer(collector)
+	defer cs.Close()
+
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer backend.Close()
+	proxy, stop := newTestProxy(t, serviceForTestServer("users", "/api", backend))
+	defer stop()
+
+	exporter := NewSpanExporter(cs.URL+"/v1/traces", "conductor")
+	go exporter.Work()
+	NewTracer(exporter, 0).Wrap(proxy).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users", nil))
+	exporter.Stop()
+
+	if !strings.HasPrefix(traceparent, "00-") || !strings.HasSuffix(traceparent, "-00") {
+		t.Errorf("Expected a new unsampled trace to be passed on but got '%s'", traceparent)
+	}
+	if len(collector.spans) != 0 {
+		t.Errorf("Expected nothing to be exported but got %d spans", len(collector.spans))
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ListenersEnv holds the names of the listeners handed to a child process
+// during an upgrade, in the same order as their file descriptors.
+const ListenersEnv = "CONDUCTOR_LISTENERS"
+
+// UpgradeParentEnv holds the pid of the process that started us during an
+// upgrade. Once we are serving we signal it to drain and exit.
+const UpgradeParentEnv = "CONDUCTOR_UPGRADE_PARENT"
+
+// The first file descriptor passed through exec.Cmd.ExtraFiles
+const firstInheritedFd = 3
+
+// Listeners keeps track of every listening socket by name so they can be
+// passed on to a new conductor binary without ever closing them.
+type Listeners struct {
+	inherited map[string]net.Listener
+	active    map[string]net.Listener
+	order     []string
+}
+
+// NewListeners picks up any listeners inherited from a parent process
+func NewListeners() (*Listeners, error) {
+	names := os.Getenv(ListenersEnv)
+	os.Unsetenv(ListenersEnv)
+	return inheritListeners(names, func(i int, name string) *os.File {
+		return os.NewFile(uintptr(firstInheritedFd+i), name)
+	})
+}
+
+// inheritListeners maps a comma separated list of listener names to the files
+// returned by fileFor.
+func inheritListeners(names string, fileFor func(int, string) *os.File) (*Listeners, error) {
+	l := &Listeners{
+		inherited: make(map[string]net.Listener),
+		active:    make(map[string]net.Listener),
+	}
+	if names == "" {
+		return l, nil
+	}
+	for i, name := range strings.Split(names, ",") {
+		f := fileFor(i, name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting listener '%s': %s", name, err)
+		}
+		l.inherited[name] = ln
+	}
+	return l, nil
+}
+
+// Listen returns the inherited listener with this name if its address matches,
+// otherwise it opens a new one.
+func (l *Listeners) Listen(name, address string) (net.Listener, error) {
+	if ln, ok := l.inherited[name]; ok {
+		delete(l.inherited, name)
+		if sameAddress(ln.Addr(), address) {
+			log.WithFields(log.Fields{"listener": name,
+				"address": ln.Addr().String()}).Info("Using inherited listener")
+			l.add(name, ln)
+			return ln, nil
+		}
+		ln.Close()
+	}
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l.add(name, ln)
+	return ln, nil
+}
+
+func (l *Listeners) add(name string, ln net.Listener) {
+	if _, ok := l.active[name]; !ok {
+		l.order = append(l.order, name)
+	}
+	l.active[name] = ln
+}
+
+// CloseUnused closes any inherited listeners this process did not ask for
+func (l *Listeners) CloseUnused() {
+	for name, ln := range l.inherited {
+		log.WithFields(log.Fields{"listener": name}).Debug("Closing unused inherited listener")
+		ln.Close()
+		delete(l.inherited, name)
+	}
+}
+
+// Upgrade starts a new copy of our binary with the same arguments and passes it
+// every active listener. The child tells us to shut down once it is serving.
+func (l *Listeners) Upgrade() (*os.Process, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(l.order))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range l.order {
+		fl, ok := l.active[name].(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("listener '%s' can not be passed to a child process", name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", ListenersEnv, strings.Join(l.order, ",")),
+		fmt.Sprintf("%s=%d", UpgradeParentEnv, os.Getpid()))
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.WithFields(log.Fields{"pid": cmd.Process.Pid,
+				"error": err}).Warn("Upgraded conductor process exited")
+			return
+		}
+		log.WithFields(log.Fields{"pid": cmd.Process.Pid}).Info("Upgraded conductor process exited")
+	}()
+	return cmd.Process, nil
+}
+
+// NotifyParent tells the process that started us during an upgrade that we are
+// serving and it can drain and exit.
+func NotifyParent() error {
+	value := os.Getenv(UpgradeParentEnv)
+	os.Unsetenv(UpgradeParentEnv)
+	if value == "" {
+		return nil
+	}
+	pid, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"parent_pid": pid}).Info("Telling parent process to drain and exit")
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// sameAddress compares a listener's address to a requested listen address
+func sameAddress(addr net.Addr, address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String() == address
+	}
+	if strconv.Itoa(tcpAddr.Port) != port {
+		return false
+	}
+	return host == "" || net.ParseIP(host).Equal(tcpAddr.IP)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// upgradeChildEnv makes the test binary act as the upgraded conductor when
+// Upgrade starts it, serving on the listener named http at this address
+const upgradeChildEnv = "CONDUCTOR_TEST_UPGRADE_CHILD"
+
+func init() {
+	if address := os.Getenv(upgradeChildEnv); address != "" {
+		os.Exit(runUpgradeChild(address))
+	}
+}
+
+// runUpgradeChild does what main does after an upgrade: takes over the
+// inherited listener, tells the parent and serves a request
+func runUpgradeChild(address string) int {
+	listeners, err := NewListeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// The parent still has the address open, so this only works if the
+	// listener is the inherited one
+	ln, err := listeners.Listen("http", address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	served := make(chan bool)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upgraded")
+		close(served)
+	})}
+	go server.Serve(ln)
+	if err := NotifyParent(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	return 0
+}
+
+func TestInheritListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners, err := inheritListeners("http", func(i int, name string) *os.File {
+		if i != 0 || name != "http" {
+			t.Errorf("Expected to be asked for listener 0 named 'http' but got %d named '%s'", i, name)
+		}
+		return f
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inherited, err := listeners.Listen("http", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+
+	if inherited.Addr().String() != ln.Addr().String() {
+		t.Errorf("Expected inherited listener on '%s' but got '%s'", ln.Addr(), inherited.Addr())
+	}
+
+	if len(listeners.order) != 1 || listeners.order[0] != "http" {
+		t.Errorf("Expected active listeners to be [http] but got %v", listeners.order)
+	}
+}
+
+func TestInheritListenersWithNoneGiven(t *testing.T) {
+	listeners, err := inheritListeners("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners.inherited) != 0 {
+		t.Errorf("Expected no inherited listeners but got %d", len(listeners.inherited))
+	}
+}
+
+func TestSameAddress(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8888}
+
+	if !sameAddress(addr, ":8888") {
+		t.Error("Expected ':8888' to match 127.0.0.1:8888")
+	}
+
+	if !sameAddress(addr, "127.0.0.1:8888") {
+		t.Error("Expected '127.0.0.1:8888' to match 127.0.0.1:8888")
+	}
+
+	if sameAddress(addr, ":8889") {
+		t.Error("Expected ':8889' not to match 127.0.0.1:8888")
+	}
+}
+
+func TestUpgradeHandsOverListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	listeners, _ := inheritListeners("", nil)
+	listeners.add("http", ln)
+
+	terminated := make(chan os.Signal, 1)
+	signal.Notify(terminated, syscall.SIGTERM)
+	defer signal.Stop(terminated)
+
+	t.Setenv(upgradeChildEnv, ln.Addr().String())
+	if _, err := listeners.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-terminated:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the child to tell us to drain and exit")
+	}
+
+	res, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "upgraded" {
+		t.Errorf("Expected the child to answer on the handed over listener but got '%s'", body)
+	}
+}
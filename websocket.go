@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpgradeTracker keeps track of upgraded connections, eg WebSockets, proxied
+// through conductor. The http.Server forgets about a connection once it's
+// hijacked so these are drained separately on shutdown.
+type UpgradeTracker struct {
+	mu    sync.Mutex
+	conns map[*idleTimeoutConn]string
+	wg    sync.WaitGroup
+}
+
+func NewUpgradeTracker() *UpgradeTracker {
+	return &UpgradeTracker{conns: make(map[*idleTimeoutConn]string)}
+}
+
+// IsUpgradeRequest checks for a Connection: Upgrade request
+func IsUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// headerHasToken checks a comma separated header like Vary or Connection for
+// a token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wrap tracks upgraded connections made through handler and closes them once
+// nothing has been sent in either direction for idleTimeout.
+func (t *UpgradeTracker) Wrap(mountPoint string, idleTimeout time.Duration, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsUpgradeRequest(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		tw := &upgradeTrackingWriter{ResponseWriter: w, tracker: t, mountPoint: mountPoint, idleTimeout: idleTimeout}
+		defer tw.release()
+		handler.ServeHTTP(tw, r)
+	})
+}
+
+// Active returns the number of upgraded connections currently open
+func (t *UpgradeTracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// UpgradeStats is how the admin API shows the open upgraded connections
+type UpgradeStats struct {
+	Active      int            `json:"active"`
+	MountPoints map[string]int `json:"mount_points"`
+}
+
+// Stats counts the upgraded connections currently open, in all and for each
+// mount point
+func (t *UpgradeTracker) Stats() UpgradeStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := UpgradeStats{Active: len(t.conns), MountPoints: make(map[string]int)}
+	for _, mountPoint := range t.conns {
+		stats.MountPoints[mountPoint]++
+	}
+	return stats
+}
+
+// NewUpgradeStatsHandler serves the tracker's stats as JSON on the admin API
+func NewUpgradeStatsHandler(t *UpgradeTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Stats())
+	})
+}
+
+// Drain waits for upgraded connections to finish on their own. Any still open
+// when ctx is done are closed.
+func (t *UpgradeTracker) Drain(ctx context.Context) {
+	done := make(chan bool)
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	log.WithFields(log.Fields{"connections": len(t.conns)}).Warn("Closing upgraded connections")
+	for c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+	<-done
+}
+
+func (t *UpgradeTracker) add(c *idleTimeoutConn, mountPoint string) {
+	t.mu.Lock()
+	t.conns[c] = mountPoint
+	t.mu.Unlock()
+}
+
+func (t *UpgradeTracker) remove(c *idleTimeoutConn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+// upgradeTrackingWriter hands out a tracked connection when the reverse proxy
+// hijacks the client connection after a 101 Switching Protocols.
+type upgradeTrackingWriter struct {
+	http.ResponseWriter
+	tracker     *UpgradeTracker
+	mountPoint  string
+	idleTimeout time.Duration
+	conn        *idleTimeoutConn
+}
+
+func (w *upgradeTrackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &idleTimeoutConn{Conn: conn, idleTimeout: w.idleTimeout}
+	w.conn.touch()
+	w.tracker.wg.Add(1)
+	w.tracker.add(w.conn, w.mountPoint)
+	log.WithFields(log.Fields{"mount_point": w.mountPoint,
+		"remote_address": conn.RemoteAddr().String(),
+		"idle_timeout":   w.idleTimeout}).Debug("Upgraded connection opened")
+	return w.conn, brw, nil
+}
+
+func (w *upgradeTrackingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// release runs once the proxy is done copying, which is when the upgraded
+// connection is finished with.
+func (w *upgradeTrackingWriter) release() {
+	if w.conn == nil {
+		return
+	}
+	w.conn.Close()
+	w.tracker.remove(w.conn)
+	w.tracker.wg.Done()
+	log.WithFields(log.Fields{"mount_point": w.mountPoint,
+		"remote_address": w.conn.RemoteAddr().String()}).Debug("Upgraded connection closed")
+}
+
+// idleTimeoutConn pushes its deadline back on every read or write, so it only
+// times out when there is no traffic in either direction.
+type idleTimeoutConn struct {
+	net.Conn
+	idleTimeout time.Duration
+}
+
+func (c *idleTimeoutConn) touch() {
+	if c.idleTimeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.idleTimeout))
+	}
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.touch()
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.touch()
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serviceForTestServer returns a service whose only node is the test server
+func serviceForTestServer(name, mountPoint string, ts *httptest.Server) Service {
+	host, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	return Service{Name: name,
+		MountPoint: mountPoint,
+		Nodes:      []Node{Node{Name: name + "1", Address: host, Port: portNumber}},
+	}
+}
+
+// newTestProxy starts a load balancer worker and reverse proxy for the service.
+// Call the returned function to stop them.
+func newTestProxy(t *testing.T, s Service) (http.Handler, func()) {
+	w := NewLoadBalancerWorker(NewNiaveRoundRobin)
+	go w.Work(s)
+	transport, err := NewBackendTransport(s.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewReverseProxyWithLoadBalancer(s, w.RequestChan, transport), func() { w.ControlChan <- true }
+}
+
+// echoUpgradeHandler switches to a line based echo protocol
+func echoUpgradeHandler(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	brw.Flush()
+	for {
+		line, err := brw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		brw.WriteString(line)
+		brw.Flush()
+	}
+}
+
+// dialUpgrade opens an upgraded echo connection through the proxy
+func dialUpgrade(t *testing.T, proxy *httptest.Server, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: conductor\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", path)
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 Switching Protocols but got %s", res.Status)
+	}
+	return conn, reader
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	if IsUpgradeRequest(r) {
+		t.Error("Expected a plain request not to be an upgrade")
+	}
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	if !IsUpgradeRequest(r) {
+		t.Error("Expected 'Connection: keep-alive, Upgrade' to be an upgrade")
+	}
+}
+
+func TestUpgradedConnectionEcho(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(echoUpgradeHandler))
+	defer backend.Close()
+
+	rp, stop := newTestProxy(t, serviceForTestServer("echo", "/echo", backend))
+	defer stop()
+	tracker := NewUpgradeTracker()
+	proxy := httptest.NewServer(tracker.Wrap("/echo", time.Minute, rp))
+	defer proxy.Close()
+
+	conn, reader := dialUpgrade(t, proxy, "/echo/socket")
+	defer conn.Close()
+
+	for _, message := range []string{"hello\n", "world\n"} {
+		fmt.Fprint(conn, message)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != message {
+			t.Errorf("Expected echo of '%s' but got '%s'", message, line)
+		}
+	}
+
+	if tracker.Active() != 1 {
+		t.Errorf("Expected 1 active upgraded connection but got %d", tracker.Active())
+	}
+	res := httptest.NewRecorder()
+	NewUpgradeStatsHandler(tracker).ServeHTTP(res, httptest.NewRequest("GET", "/_admin/upgrades", nil))
+	var stats UpgradeStats
+	if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Active != 1 || stats.MountPoints["/echo"] != 1 {
+		t.Errorf("Expected the admin API to report the connection but got %s", res.Body.String())
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return tracker.Active() == 0 })
+}
+
+func TestUpgradedConnectionIdleTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(echoUpgradeHandler))
+	defer backend.Close()
+
+	rp, stop := newTestProxy(t, serviceForTestServer("echo", "/echo", backend))
+	defer stop()
+	tracker := NewUpgradeTracker()
+	proxy := httptest.NewServer(tracker.Wrap("/echo", 100*time.Millisecond, rp))
+	defer proxy.Close()
+
+	conn, reader := dialUpgrade(t, proxy, "/echo/socket")
+	defer conn.Close()
+
+	// Traffic keeps the connection open past the idle timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(conn, "ping\n")
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("Expected the connection to stay open while in use but got %s", err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Expected the idle connection to be closed")
+	}
+	waitFor(t, func() bool { return tracker.Active() == 0 })
+}
+
+func TestUpgradeTrackerDrainClosesConnections(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(echoUpgradeHandler))
+	defer backend.Close()
+
+	rp, stop := newTestProxy(t, serviceForTestServer("echo", "/echo", backend))
+	defer stop()
+	tracker := NewUpgradeTracker()
+	proxy := httptest.NewServer(tracker.Wrap("/echo", time.Minute, rp))
+	defer proxy.Close()
+
+	conn, reader := dialUpgrade(t, proxy, "/echo/socket")
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tracker.Drain(ctx)
+
+	if tracker.Active() != 0 {
+		t.Errorf("Expected no active connections after draining but got %d", tracker.Active())
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Expected the connection to be closed by the drain")
+	}
+}
+
+// waitFor polls until condition is true or a second has passed
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
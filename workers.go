@@ -1,8 +1,9 @@
 package main
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"fmt"
 	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
 	"net/url"
 	"time"
 )
@@ -139,6 +140,97 @@ func (w *ConsulHealthWorker) BlockUntilConsulUpdate() {
 	return
 }
 
+// ConsulServiceWorker watches a service's definition in the KV store so the
+// settings that can change while running, like split weights, pick up edits.
+type ConsulServiceWorker struct {
+	ControlChan  chan bool
+	InputChan    chan *api.KVPair
+	consul       *Consul
+	service      Service
+	key          string
+	queryOptions *api.QueryOptions
+	lastIndex    uint64
+	subscribers  []func(Service)
+}
+
+func NewConsulServiceWorker(c *Consul, service Service) *ConsulServiceWorker {
+	return &ConsulServiceWorker{
+		ControlChan:  make(chan bool, 1),
+		InputChan:    make(chan *api.KVPair, 1),
+		consul:       c,
+		service:      service,
+		key:          fmt.Sprintf("%s/%s", c.KVPrefix, service.Name),
+		queryOptions: &api.QueryOptions{WaitTime: time.Duration(30) * time.Second, RequireConsistent: true},
+	}
+}
+
+// Subscribe calls f with the new definition whenever it changes. Call it
+// before Work.
+func (w *ConsulServiceWorker) Subscribe(f func(Service)) {
+	w.subscribers = append(w.subscribers, f)
+}
+
+func (w *ConsulServiceWorker) Work() {
+	go w.BlockUntilKVUpdate()
+	for {
+		select {
+		case kv := <-w.InputChan:
+			if kv != nil {
+				service := w.consul.MapKVToService(kv)
+				for _, f := range w.subscribers {
+					f(*service)
+				}
+			}
+			go w.BlockUntilKVUpdate()
+		case _ = <-w.ControlChan:
+			return
+		}
+	}
+}
+
+// BlockUntilKVUpdate sends the definition when it has changed since we last
+// looked, or nil if it hasn't
+func (w *ConsulServiceWorker) BlockUntilKVUpdate() {
+	kv, queryMeta, err := w.consul.Client.KV().Get(w.key, w.queryOptions)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"mount_point": w.service.MountPoint,
+			"key":         w.key,
+			"error":       err,
+			"worker_type": "consul_service"}).Error("Error getting service definition from consul")
+		time.Sleep(time.Duration(7) * time.Second)
+		w.InputChan <- nil
+		return
+	}
+
+	// The first answer is sent too, in case the definition changed after
+	// we loaded it at startup
+	if queryMeta.LastIndex == w.lastIndex {
+		w.InputChan <- nil
+		return
+	}
+	if queryMeta.LastIndex < w.lastIndex {
+		// Consul's state was reset, eg restored from a snapshot, so start over
+		// rather than wait for an index that may never come
+		w.lastIndex = 0
+		w.queryOptions.WaitIndex = 0
+	} else {
+		w.lastIndex = queryMeta.LastIndex
+		w.queryOptions.WaitIndex = queryMeta.LastIndex
+	}
+	if kv == nil {
+		// Removing a service needs a restart
+		w.InputChan <- nil
+		return
+	}
+	log.WithFields(log.Fields{
+		"mount_point": w.service.MountPoint,
+		"key":         w.key,
+		"new_index":   queryMeta.LastIndex,
+		"worker_type": "consul_service"}).Debug("Service definition changed")
+	w.InputChan <- kv
+}
+
 // NewBackoff returns a function that can be called multiple times to return an incrementing number
 // It should not exceed the limit given.
 // TODO: integrate this in some way to the health checks.